@@ -1,36 +1,74 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"time"
 )
 
-var target = flag.String("target", "http://localhost:8081", "request target")
+var (
+	target      = flag.String("target", "http://localhost:8081", "request target")
+	endpoint    = flag.String("endpoint", "api", "API to load: api (/api/v1/some-data) or db (/db/)")
+	concurrency = flag.Int("concurrency", 4, "number of concurrent workers")
+	rps         = flag.Float64("rps", 0, "target requests per second across all workers; zero means unlimited")
+	duration    = flag.Duration("duration", 10*time.Second, "how long to generate load")
+	writes      = flag.Float64("writes", 0, "fraction of requests that are writes, from 0 to 1")
+	keys        = flag.Int("keys", 100, "number of distinct keys")
+	dist        = flag.String("dist", "uniform", "key distribution: uniform or zipf")
+	zipfS       = flag.Float64("zipf-s", 1.1, "zipf distribution skew, must be greater than 1")
+	valueSize   = flag.Int("value-size", 64, "size of written values in bytes")
+	timeout     = flag.Duration("timeout", 10*time.Second, "per-request timeout")
+	jsonOutput  = flag.Bool("json", false, "print the report as JSON")
+)
 
 func main() {
 	flag.Parse()
-	client := new(http.Client)
-	client.Timeout = 10 * time.Second
-
-	for range time.Tick(1 * time.Second) {
-		resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data?key=teamye", *target))
-		if err == nil {
-			log.Printf("response %d", resp.StatusCode)
-		} else {
-			log.Printf("error %s", err)
-		}
-		defer resp.Body.Close()
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("error reading response body: %s", err)
-			continue
-		}
+	cfg := config{
+		Target:      *target,
+		Endpoint:    *endpoint,
+		Concurrency: *concurrency,
+		RPS:         *rps,
+		Duration:    *duration,
+		Writes:      *writes,
+		Keys:        *keys,
+		Dist:        *dist,
+		ZipfS:       *zipfS,
+		ValueSize:   *valueSize,
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
 
-		log.Printf("response %d: %s", resp.StatusCode, body)
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: cfg.Concurrency,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Duration)
+	defer cancel()
+
+	if !*jsonOutput {
+		log.Printf("Sending load to %s for %s", cfg.Target, cfg.Duration)
+	}
+	rep := run(ctx, client, cfg)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rep); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
+	rep.print(os.Stdout)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for p, expected := range map[float64]time.Duration{50: 50 * time.Millisecond, 95: 95 * time.Millisecond, 99: 99 * time.Millisecond, 100: 100 * time.Millisecond} {
+		if got := percentile(sorted, p); got != expected {
+			t.Errorf("p%.0f: expected %s, got %s", p, expected, got)
+		}
+	}
+	if percentile(nil, 50) != 0 {
+		t.Error("Expected zero percentile for no samples")
+	}
+}
+
+func TestZipfKeys(t *testing.T) {
+	cfg := config{Keys: 100, Dist: "zipf", ZipfS: 1.5}
+	next := newKeyGenerator(cfg, rand.New(rand.NewSource(1)))
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[next()]++
+	}
+	if counts["key-0"] < counts["key-50"]*10 {
+		t.Errorf("Zipf distribution is not skewed: %d vs %d", counts["key-0"], counts["key-50"])
+	}
+	for k := range counts {
+		if !strings.HasPrefix(k, "key-") {
+			t.Errorf("Unexpected key %q", k)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	var reads, writes atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/db/key-") {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.Method == http.MethodPost {
+			writes.Add(1)
+			rw.WriteHeader(http.StatusCreated)
+			return
+		}
+		if reads.Add(1)%2 == 0 {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config{
+		Target:      srv.URL,
+		Endpoint:    "db",
+		Concurrency: 2,
+		RPS:         200,
+		Duration:    300 * time.Millisecond,
+		Writes:      0.5,
+		Keys:        10,
+		Dist:        "uniform",
+		ValueSize:   8,
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Duration)
+	defer cancel()
+	rep := run(ctx, srv.Client(), cfg)
+
+	if rep.Requests == 0 || rep.Requests > 70 {
+		t.Errorf("Unexpected number of requests %d for the rate limit", rep.Requests)
+	}
+	// Requests interrupted by the end of the run may reach the server without being reported.
+	if lost := reads.Load() + writes.Load() - int64(rep.Requests); lost < 0 || lost > int64(cfg.Concurrency) {
+		t.Errorf("Report counts %d/%d do not match server counts %d/%d", rep.Reads, rep.Writes, reads.Load(), writes.Load())
+	}
+	if rep.Errors != rep.Failures["status 404"] {
+		t.Errorf("Unexpected failure breakdown %v", rep.Failures)
+	}
+	if rep.Latency.P50 <= 0 || rep.Latency.P99 < rep.Latency.P50 {
+		t.Errorf("Unexpected latencies %+v", rep.Latency)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type config struct {
+	Target      string        `json:"target"`
+	Endpoint    string        `json:"endpoint"`
+	Concurrency int           `json:"concurrency"`
+	RPS         float64       `json:"rps"`
+	Duration    time.Duration `json:"-"`
+	Writes      float64       `json:"writes"`
+	Keys        int           `json:"keys"`
+	Dist        string        `json:"dist"`
+	ZipfS       float64       `json:"zipfS,omitempty"`
+	ValueSize   int           `json:"valueSize"`
+}
+
+func (c config) validate() error {
+	switch {
+	case c.Endpoint != "api" && c.Endpoint != "db":
+		return fmt.Errorf("unknown endpoint %q", c.Endpoint)
+	case c.Concurrency < 1:
+		return fmt.Errorf("concurrency must be positive")
+	case c.RPS < 0:
+		return fmt.Errorf("rps must not be negative")
+	case c.Duration <= 0:
+		return fmt.Errorf("duration must be positive")
+	case c.Writes < 0 || c.Writes > 1:
+		return fmt.Errorf("writes must be between 0 and 1")
+	case c.Keys < 1:
+		return fmt.Errorf("keys must be positive")
+	case c.Dist != "uniform" && c.Dist != "zipf":
+		return fmt.Errorf("unknown key distribution %q", c.Dist)
+	case c.Dist == "zipf" && c.ZipfS <= 1:
+		return fmt.Errorf("zipf-s must be greater than 1")
+	}
+	return nil
+}
+
+type keyGenerator func() string
+
+func newKeyGenerator(cfg config, r *rand.Rand) keyGenerator {
+	if cfg.Dist == "zipf" {
+		z := rand.NewZipf(r, cfg.ZipfS, 1, uint64(cfg.Keys-1))
+		return func() string { return fmt.Sprintf("key-%d", z.Uint64()) }
+	}
+	return func() string { return fmt.Sprintf("key-%d", r.Intn(cfg.Keys)) }
+}
+
+type sample struct {
+	write   bool
+	latency time.Duration
+	failure string
+}
+
+func run(ctx context.Context, client *http.Client, cfg config) report {
+	var tokens <-chan time.Time
+	if cfg.RPS > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.RPS))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	samples := make(chan sample, cfg.Concurrency*16)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			w := &worker{
+				client: client,
+				cfg:    cfg,
+				rand:   rand.New(rand.NewSource(seed)),
+			}
+			w.keys = newKeyGenerator(cfg, w.rand)
+			w.loop(ctx, tokens, samples)
+		}(time.Now().UnixNano() + int64(i))
+	}
+	go func() {
+		wg.Wait()
+		close(samples)
+	}()
+
+	start := time.Now()
+	var all []sample
+	for s := range samples {
+		all = append(all, s)
+	}
+	return newReport(cfg, time.Since(start), all)
+}
+
+type worker struct {
+	client *http.Client
+	cfg    config
+	rand   *rand.Rand
+	keys   keyGenerator
+}
+
+func (w *worker) loop(ctx context.Context, tokens <-chan time.Time, out chan<- sample) {
+	for {
+		if tokens != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tokens:
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		write := w.rand.Float64() < w.cfg.Writes
+		req, err := w.request(ctx, write, w.keys())
+		if err != nil {
+			out <- sample{write: write, failure: "bad request: " + err.Error()}
+			continue
+		}
+
+		start := time.Now()
+		failure := w.do(req)
+		if ctx.Err() != nil && failure != "" {
+			// Requests cut short by the end of the run are not failures of the target.
+			return
+		}
+		out <- sample{write: write, latency: time.Since(start), failure: failure}
+	}
+}
+
+func (w *worker) request(ctx context.Context, write bool, key string) (*http.Request, error) {
+	target := strings.TrimSuffix(w.cfg.Target, "/")
+	var u string
+	if w.cfg.Endpoint == "db" {
+		u = target + "/db/" + url.PathEscape(key)
+	} else {
+		u = target + "/api/v1/some-data?key=" + url.QueryEscape(key)
+	}
+
+	if !write {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	}
+
+	value := make([]byte, w.cfg.ValueSize)
+	for i := range value {
+		value[i] = 'a' + byte(w.rand.Intn(26))
+	}
+	body, err := json.Marshal(map[string]string{"value": string(value)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// do sends the request and returns an empty string on success or a failure category.
+func (w *worker) do(req *http.Request) string {
+	resp, err := w.client.Do(req)
+	if err != nil {
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return "timeout"
+		}
+		return "connection error"
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return ""
+}
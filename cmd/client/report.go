@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+type latencies struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// report summarizes a run; latencies are in milliseconds.
+type report struct {
+	Config   config         `json:"config"`
+	Elapsed  float64        `json:"elapsedSec"`
+	Requests int            `json:"requests"`
+	Reads    int            `json:"reads"`
+	Writes   int            `json:"writes"`
+	Errors   int            `json:"errors"`
+	RPS      float64        `json:"rps"`
+	Latency  latencies      `json:"latencyMs"`
+	Failures map[string]int `json:"failures"`
+}
+
+func newReport(cfg config, elapsed time.Duration, samples []sample) report {
+	rep := report{
+		Config:   cfg,
+		Elapsed:  elapsed.Seconds(),
+		Requests: len(samples),
+		Failures: make(map[string]int),
+	}
+
+	durations := make([]time.Duration, 0, len(samples))
+	var total time.Duration
+	for _, s := range samples {
+		if s.write {
+			rep.Writes++
+		} else {
+			rep.Reads++
+		}
+		if s.failure != "" {
+			rep.Errors++
+			rep.Failures[s.failure]++
+		}
+		if s.latency > 0 {
+			durations = append(durations, s.latency)
+			total += s.latency
+		}
+	}
+	if elapsed > 0 {
+		rep.RPS = float64(len(samples)) / elapsed.Seconds()
+	}
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		rep.Latency = latencies{
+			Mean: ms(total / time.Duration(len(durations))),
+			P50:  ms(percentile(durations, 50)),
+			P95:  ms(percentile(durations, 95)),
+			P99:  ms(percentile(durations, 99)),
+			Max:  ms(durations[len(durations)-1]),
+		}
+	}
+	return rep
+}
+
+// percentile uses the nearest-rank method on sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r report) print(out io.Writer) {
+	fmt.Fprintf(out, "Target:     %s (%s)\n", r.Config.Target, r.Config.Endpoint)
+	fmt.Fprintf(out, "Requests:   %d in %.1fs (%.1f req/s), %d reads, %d writes\n", r.Requests, r.Elapsed, r.RPS, r.Reads, r.Writes)
+	fmt.Fprintf(out, "Latency:    mean %.2fms, p50 %.2fms, p95 %.2fms, p99 %.2fms, max %.2fms\n",
+		r.Latency.Mean, r.Latency.P50, r.Latency.P95, r.Latency.P99, r.Latency.Max)
+	fmt.Fprintf(out, "Errors:     %d\n", r.Errors)
+
+	failures := make([]string, 0, len(r.Failures))
+	for f := range r.Failures {
+		failures = append(failures, f)
+	}
+	sort.Strings(failures)
+	for _, f := range failures {
+		fmt.Fprintf(out, "  %-20s %d\n", f, r.Failures[f])
+	}
+}
@@ -1,78 +1,170 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
+	"fmt"
 	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbserver"
 	"github.com/KPI-3-Architecture-Labs/lab4/httptools"
+	"github.com/KPI-3-Architecture-Labs/lab4/replication"
 	"github.com/KPI-3-Architecture-Labs/lab4/signal"
+	"github.com/KPI-3-Architecture-Labs/lab4/tracing"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"time"
 )
 
-var port = flag.Int("port", 8083, "server port")
+var (
+	port           = flag.Int("port", 8083, "server port")
+	engine         = flag.String("engine", "log", "storage engine: log (hash-indexed log segments) or lsm (sorted tables)")
+	memtableSize   = flag.Int64("memtable-size", 1<<20, "bytes of writes the lsm engine buffers before writing a table")
+	dataDir        = flag.String("dir", "", "directory of the segment files; empty uses a new temporary directory")
+	segmentSize    = flag.Int64("segment-size", 8<<20, "bytes after which the log engine starts a new segment file")
+	cacheSize      = flag.Int64("cache-size", 8<<20, "bytes of recently read records to keep in memory, zero disables the cache")
+	compaction     = flag.String("compaction", "size-tiered", "compaction policy: size-tiered or garbage-ratio")
+	garbageRatio   = flag.Float64("garbage-ratio", 0.5, "share of dead bytes that makes the garbage-ratio policy rewrite a segment")
+	compactionRate = flag.Int64("compaction-rate", 0, "bytes per second compaction may write, zero for no limit")
+	compression    = flag.Int("compression-threshold", 0, "compress values of at least this many bytes with flate, zero disables compression")
+	compactIndex   = flag.Bool("compact-index", false, "keep the indexes of sealed segments as sorted key blocks to save memory")
+	keyFile        = flag.String("encryption-key-file", "", "file of ID:HEX AES keys to encrypt values with, the first one current; defaults to DB_ENCRYPTION_KEYS")
+	maxKeySize     = flag.Int("max-key-size", datastore.DefaultMaxKeySize, "longest key in bytes the db accepts")
+	maxValueSize   = flag.Int("max-value-size", datastore.DefaultMaxValueSize, "largest value in bytes the db accepts")
+	maxBodySize    = flag.Int64("max-body-size", dbserver.DefaultMaxBodySize, "largest request body in bytes the db accepts")
+	traceExport    = flag.String("trace-export", "", "where to export tracing spans: a file path, \"stdout\" or empty to disable")
+
+	leaderURL           = flag.String("leader", "", "base URL of the leader to replicate from; empty runs as the leader")
+	replicaID           = flag.String("replica-id", hostname(), "name of this follower in the leader's follower list")
+	replicationInterval = flag.Duration("replication-interval", time.Second, "how often a follower fetches new records from the leader")
+)
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(os.Args[2:])
+		return
+	}
+	flag.Parse()
 
-	dir, err := ioutil.TempDir("", "temp-dir")
+	exporter, err := tracing.NewExporter(*traceExport)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Failed to set up trace export: %s", err)
+	}
+	tracer := tracing.NewTracer("db", exporter)
+	defer tracer.Close()
+
+	dir := *dataDir
+	if dir == "" {
+		if dir, err = ioutil.TempDir("", "temp-dir"); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	db, err := datastore.NewDb(dir, 250)
+	var policy datastore.CompactionPolicy
+	switch *compaction {
+	case "size-tiered":
+		policy = datastore.SizeTiered{MinSegments: 4, Ratio: 2}
+	case "garbage-ratio":
+		policy = datastore.GarbageRatio{Threshold: *garbageRatio}
+	default:
+		log.Fatalf("Unknown compaction policy %q", *compaction)
+	}
+
+	keys, err := datastore.ReadKeyring(*keyFile, "DB_ENCRYPTION_KEYS")
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Failed to read the encryption keys: %s", err)
 	}
-	defer db.Close()
 
-	h := http.NewServeMux()
-
-	h.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
-		key := req.URL.Path[4:]
-
-		switch req.Method {
-		case http.MethodGet:
-			value, err := db.Get(key)
-			if err != nil {
-				rw.WriteHeader(http.StatusNotFound)
-				json.NewEncoder(rw).Encode(map[string]string{"error": "Not found"})
-				return
-			}
-
-			resp := struct {
-				Key   string `json:"key"`
-				Value string `json:"value"`
-			}{Key: key, Value: value}
-
-			rw.Header().Set("Content-Type", "application/json")
-			rw.WriteHeader(http.StatusOK)
-			json.NewEncoder(rw).Encode(resp)
-
-		case http.MethodPost:
-			var body struct {
-				Value string `json:"value"`
-			}
-			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
-				rw.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(rw).Encode(map[string]string{"error": "Bad request"})
-				return
-			}
-
-			if err := db.Put(key, body.Value); err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(rw).Encode(map[string]string{"error": "Internal Server Error"})
-				return
-			}
-			rw.WriteHeader(http.StatusCreated)
-
-		default:
-			rw.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(rw).Encode(map[string]string{"error": "Method not allowed"})
+	mux := http.NewServeMux()
+	var db datastore.Store
+	switch *engine {
+	case "log":
+		opts := []datastore.Option{
+			datastore.WithCacheSize(*cacheSize),
+			datastore.WithCompression(*compression),
+			datastore.WithCompactionPolicy(policy),
+			datastore.WithCompactionRate(*compactionRate),
+			datastore.WithSizeLimits(*maxKeySize, *maxValueSize),
+		}
+		if *compactIndex {
+			opts = append(opts, datastore.WithCompactIndex())
+		}
+		if keys != nil {
+			opts = append(opts, datastore.WithEncryption(keys))
+		}
+		logDb, err := datastore.NewDb(dir, *segmentSize, opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db = logDb
+		// Every node serves its log, so followers can switch to a promoted one.
+		mux.Handle("/replication/", replication.NewLeader(logDb).Handler())
+	case "lsm":
+		if *leaderURL != "" {
+			log.Fatal("Replication needs the log engine")
 		}
-	})
+		if keys != nil {
+			log.Fatal("Encryption needs the log engine")
+		}
+		if db, err = datastore.NewLSM(dir,
+			datastore.WithMemtableSize(*memtableSize),
+			datastore.WithCompression(*compression),
+			datastore.WithSizeLimits(*maxKeySize, *maxValueSize)); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown storage engine %q", *engine)
+	}
+	defer db.Close()
 
-	server := httptools.CreateServer(*port, h)
+	limits := dbserver.WithLimits(*maxKeySize, *maxBodySize)
+	if *leaderURL == "" {
+		mux.Handle("/", dbserver.NewHandler(db, tracer, limits))
+	} else {
+		follower := replication.NewFollower(db.(*datastore.Db), *leaderURL, *replicaID)
+		mux.Handle("/", dbserver.NewHandler(db, tracer, limits, dbserver.WithReadOnly(follower.ReadOnly)))
+		mux.Handle("/admin/promote", follower.Handler())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go follower.Run(ctx, *replicationInterval)
+		log.Printf("Following %s as %s", *leaderURL, *replicaID)
+	}
+
+	server := httptools.CreateServer(*port, tracer.Handler(mux))
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
+
+// restore implements "db restore -dir DIR ARCHIVE", which unpacks a backup taken from
+// GET /admin/backup into an empty directory to start a db from. "-" reads stdin.
+func restore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", "", "empty directory to restore the segment files into")
+	fs.Parse(args)
+	if *dir == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: db restore -dir DIR ARCHIVE")
+		os.Exit(2)
+	}
+
+	in := os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if err := datastore.Restore(in, *dir); err != nil {
+		log.Fatalf("Failed to restore: %s", err)
+	}
+	log.Printf("Restored %s into %s", fs.Arg(0), *dir)
+}
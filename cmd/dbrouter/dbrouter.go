@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbserver"
+	"github.com/KPI-3-Architecture-Labs/lab4/httptools"
+	"github.com/KPI-3-Architecture-Labs/lab4/signal"
+	"github.com/KPI-3-Architecture-Labs/lab4/tracing"
+)
+
+var (
+	port        = flag.Int("port", 8085, "router port")
+	nodes       = flag.String("nodes", "http://db:8083", "comma separated base URLs of the db nodes")
+	replicas    = flag.Int("replicas", 100, "points every node owns on the hash ring")
+	maxKeySize  = flag.Int("max-key-size", datastore.DefaultMaxKeySize, "longest key in bytes the router accepts")
+	maxBodySize = flag.Int64("max-body-size", dbserver.DefaultMaxBodySize, "largest request body in bytes the router accepts")
+	traceExport = flag.String("trace-export", "", "where to export tracing spans: a file path, \"stdout\" or empty to disable")
+)
+
+func splitNodes(list string) []string {
+	var res []string
+	for _, n := range strings.Split(list, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			res = append(res, strings.TrimSuffix(n, "/"))
+		}
+	}
+	return res
+}
+
+func main() {
+	flag.Parse()
+
+	exporter, err := tracing.NewExporter(*traceExport)
+	if err != nil {
+		log.Fatalf("Failed to set up trace export: %s", err)
+	}
+	tracer := tracing.NewTracer("dbrouter", exporter)
+	defer tracer.Close()
+
+	nodeList := splitNodes(*nodes)
+	if len(nodeList) == 0 {
+		log.Fatal("At least one db node is required in -nodes")
+	}
+
+	httpClient := &http.Client{Transport: tracer.Transport(dbclient.NewTransport()), Timeout: 10 * time.Second}
+	rt := newRouter(newRing(*replicas, nodeList...), func(node string) *dbclient.Client {
+		return dbclient.New(node, dbclient.WithHTTPClient(httpClient))
+	})
+
+	server := httptools.CreateServer(*port, tracer.Handler(newHandler(rt, dbserver.Limits{MaxKeySize: *maxKeySize, MaxBodySize: *maxBodySize})))
+	server.Start()
+	signal.WaitForTerminationSignal()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbserver"
+)
+
+// handler serves the cmd/db HTTP API under /db/ on top of the router, plus
+// /admin/nodes to list and add nodes. Transactions and watches would have to span
+// nodes, so they are answered with 501 Not Implemented like an engine without them.
+type handler struct {
+	router *router
+	limits dbserver.Limits
+}
+
+// newHandler checks keys and request bodies with limits before they reach the nodes.
+func newHandler(rt *router, limits dbserver.Limits) http.Handler {
+	h := &handler{router: rt, limits: limits}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db/", h.serveKey)
+	mux.HandleFunc("/db/_scan", h.serveScan)
+	mux.HandleFunc("/db/_batch", h.serveBatch)
+	mux.HandleFunc("/db/_txn", notImplemented("Transactions are not supported across db nodes"))
+	mux.HandleFunc("/db/_watch", notImplemented("Watching is not supported across db nodes"))
+	mux.HandleFunc("/admin/nodes", h.serveNodes)
+	return mux
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func writeError(rw http.ResponseWriter, status int, message string) {
+	writeJSON(rw, status, map[string]string{"error": message})
+}
+
+func notImplemented(message string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		writeError(rw, http.StatusNotImplemented, message)
+	}
+}
+
+// writeDbError passes on the client errors of a node and reports everything else as
+// a bad gateway.
+func writeDbError(rw http.ResponseWriter, err error) {
+	var statusErr *dbclient.StatusError
+	switch {
+	case errors.Is(err, dbclient.ErrNotFound):
+		writeError(rw, http.StatusNotFound, "Not found")
+	case errors.Is(err, dbclient.ErrBadRequest) && errors.As(err, &statusErr):
+		writeError(rw, statusErr.Code, statusErr.Message)
+	default:
+		log.Printf("Db node request failed: %s", err)
+		writeError(rw, http.StatusBadGateway, "Db node is unavailable")
+	}
+}
+
+// serveKey serves a single key like the db does, with the value as JSON or text/plain.
+func (h *handler) serveKey(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete:
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		writeError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	key, ok := h.limits.Key(rw, req)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		contentType, ok := dbserver.AcceptValue(rw, req)
+		if !ok {
+			return
+		}
+		value, err := h.router.Get(ctx, key)
+		if err != nil {
+			writeDbError(rw, err)
+			return
+		}
+		dbserver.WriteValue(rw, req, contentType, key, value)
+
+	case http.MethodPut, http.MethodPost:
+		value, ok := h.limits.ReadValue(rw, req)
+		if !ok {
+			return
+		}
+		if err := h.router.Put(ctx, key, value); err != nil {
+			writeDbError(rw, err)
+			return
+		}
+		if req.Method == http.MethodPut {
+			rw.WriteHeader(http.StatusNoContent)
+		} else {
+			rw.WriteHeader(http.StatusCreated)
+		}
+
+	case http.MethodDelete:
+		if err := h.router.Delete(ctx, key); err != nil {
+			writeDbError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *handler) serveScan(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		writeError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	limit := 0
+	if l := req.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			writeError(rw, http.StatusBadRequest, "Bad limit")
+			return
+		}
+		limit = n
+	}
+
+	items, err := h.router.Scan(req.Context(), req.URL.Query().Get("prefix"), req.URL.Query().Get("after"), limit)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, dbserver.ScanResponse{Items: items})
+}
+
+func (h *handler) serveBatch(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", "POST")
+		writeError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var ops []dbserver.BatchOp
+	if !h.limits.DecodeBody(rw, req, &ops) {
+		return
+	}
+
+	batch := make([]batchOp, 0, len(ops))
+	for _, op := range ops {
+		if message := h.limits.CheckKey(op.Key); message != "" {
+			writeError(rw, http.StatusBadRequest, message)
+			return
+		}
+		switch {
+		case op.Op == "put":
+			batch = append(batch, batchOp{key: op.Key, value: op.Value})
+		case op.Op == "delete":
+			batch = append(batch, batchOp{key: op.Key, deleted: true})
+		default:
+			writeError(rw, http.StatusBadRequest, "Unknown operation "+strconv.Quote(op.Op))
+			return
+		}
+	}
+
+	if err := h.router.Batch(req.Context(), batch); err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// serveNodes lists the nodes on GET and starts adding the node {"address": ...} on POST.
+func (h *handler) serveNodes(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, h.router.Status())
+
+	case http.MethodPost:
+		var body struct {
+			Address string `json:"address"`
+		}
+		if !h.limits.DecodeBody(rw, req, &body) {
+			return
+		}
+		if body.Address == "" {
+			writeError(rw, http.StatusBadRequest, "Node address required")
+			return
+		}
+		err := h.router.AddNode(body.Address)
+		if err == errMigrating || err == errKnownNode {
+			writeError(rw, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(rw, http.StatusAccepted, h.router.Status())
+
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		writeError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
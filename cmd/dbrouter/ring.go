@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// ring is a consistent hash ring. Every node owns replicas points on it, so adding a
+// node only moves the keys that now fall on the new node's points. A ring is never
+// changed once built.
+type ring struct {
+	replicas int
+	nodes    []string
+	points   []uint32
+	owners   map[uint32]string
+}
+
+func newRing(replicas int, nodes ...string) *ring {
+	r := &ring{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+	}
+	for _, node := range nodes {
+		r.addPoints(node)
+	}
+	return r
+}
+
+// hashKey spreads similar keys, like key1 and key2, far apart on the ring, which FNV
+// does not do well enough.
+func hashKey(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func (r *ring) addPoints(node string) {
+	r.nodes = append(r.nodes, node)
+	for i := 0; i < r.replicas; i++ {
+		point := hashKey(fmt.Sprintf("%s#%d", node, i))
+		if _, taken := r.owners[point]; taken {
+			continue
+		}
+		r.owners[point] = node
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// with returns a copy of the ring that also contains node.
+func (r *ring) with(node string) *ring {
+	return newRing(r.replicas, append(append([]string(nil), r.nodes...), node)...)
+}
+
+func (r *ring) has(node string) bool {
+	for _, n := range r.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// node returns the node that owns key: the one with the first point after the key's hash.
+func (r *ring) node(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+)
+
+var (
+	errMigrating = errors.New("a node is already being added")
+	errKnownNode = errors.New("node is already in the ring")
+)
+
+// router partitions keys across db nodes. While a node is being added, keys that move
+// to it are looked up on both their new and previous owner, and every operation on such
+// a key is serialized with moving it.
+type router struct {
+	newClient func(node string) *dbclient.Client
+
+	// Operations hold mutex for reading, so swapping the rings waits for them.
+	mutex   sync.RWMutex
+	ring    *ring
+	prev    *ring
+	clients map[string]*dbclient.Client
+
+	locks       [64]sync.Mutex
+	moved       atomic.Int64
+	migrations  sync.WaitGroup
+	retryDelay  time.Duration
+	migratePage int
+}
+
+func newRouter(r *ring, newClient func(node string) *dbclient.Client) *router {
+	rt := &router{
+		newClient:   newClient,
+		ring:        r,
+		clients:     make(map[string]*dbclient.Client),
+		retryDelay:  time.Second,
+		migratePage: 1000,
+	}
+	for _, node := range r.nodes {
+		rt.clients[node] = newClient(node)
+	}
+	return rt
+}
+
+// acquire returns the owner of key and, during a migration, its previous owner if that
+// is another node. release must be called once the operation is done.
+func (rt *router) acquire(key string) (owner, prev *dbclient.Client, release func()) {
+	rt.mutex.RLock()
+	owner = rt.clients[rt.ring.node(key)]
+	if rt.prev == nil {
+		return owner, nil, rt.mutex.RUnlock
+	}
+	prev = rt.clients[rt.prev.node(key)]
+	if prev == owner {
+		return owner, nil, rt.mutex.RUnlock
+	}
+
+	lock := rt.lock(key)
+	lock.Lock()
+	return owner, prev, func() {
+		lock.Unlock()
+		rt.mutex.RUnlock()
+	}
+}
+
+func (rt *router) lock(key string) *sync.Mutex {
+	return &rt.locks[hashKey(key)%uint32(len(rt.locks))]
+}
+
+func (rt *router) Get(ctx context.Context, key string) (string, error) {
+	owner, prev, release := rt.acquire(key)
+	defer release()
+
+	value, err := owner.Get(ctx, key)
+	if prev != nil && errors.Is(err, dbclient.ErrNotFound) {
+		return prev.Get(ctx, key)
+	}
+	return value, err
+}
+
+func (rt *router) Put(ctx context.Context, key, value string) error {
+	owner, prev, release := rt.acquire(key)
+	defer release()
+
+	if err := owner.Put(ctx, key, value); err != nil {
+		return err
+	}
+	if prev != nil {
+		// Otherwise the migration would overwrite the new value with the old one.
+		return ignoreNotFound(prev.Delete(ctx, key))
+	}
+	return nil
+}
+
+func (rt *router) Delete(ctx context.Context, key string) error {
+	owner, prev, release := rt.acquire(key)
+	defer release()
+
+	err := owner.Delete(ctx, key)
+	if prev == nil {
+		return err
+	}
+	if err != nil && !errors.Is(err, dbclient.ErrNotFound) {
+		return err
+	}
+	prevErr := prev.Delete(ctx, key)
+	if err == nil {
+		return ignoreNotFound(prevErr)
+	}
+	return prevErr
+}
+
+func ignoreNotFound(err error) error {
+	if errors.Is(err, dbclient.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Scan queries every node in parallel for the keys after after and merges their
+// results. During a migration it holds all key locks, as a key that moves between the
+// queries of its two nodes would be missed otherwise. A key found on both nodes has
+// not been deleted from its previous owner yet; the value of its current owner wins.
+func (rt *router) Scan(ctx context.Context, prefix, after string, limit int) ([]dbclient.KeyValue, error) {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	if rt.prev != nil {
+		for i := range rt.locks {
+			rt.locks[i].Lock()
+			defer rt.locks[i].Unlock()
+		}
+	}
+
+	type result struct {
+		node  string
+		items []dbclient.KeyValue
+		err   error
+	}
+	results := make(chan result, len(rt.ring.nodes))
+	for _, node := range rt.ring.nodes {
+		go func(node string) {
+			items, err := rt.clients[node].ScanAfter(ctx, prefix, after, limit)
+			results <- result{node: node, items: items, err: err}
+		}(node)
+	}
+
+	merged := make(map[string]string)
+	for range rt.ring.nodes {
+		res := <-results
+		if res.err != nil {
+			return nil, res.err
+		}
+		for _, kv := range res.items {
+			if _, dup := merged[kv.Key]; dup && rt.ring.node(kv.Key) != res.node {
+				continue
+			}
+			merged[kv.Key] = kv.Value
+		}
+	}
+
+	items := make([]dbclient.KeyValue, 0, len(merged))
+	for key, value := range merged {
+		items = append(items, dbclient.KeyValue{Key: key, Value: value})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+// batchOp is an operation of router.Batch.
+type batchOp struct {
+	key, value string
+	deleted    bool
+}
+
+// Batch splits the operations by node and sends every node its share as one batch,
+// so they are atomic per node only. During a migration the operations are applied one
+// by one.
+func (rt *router) Batch(ctx context.Context, ops []batchOp) error {
+	rt.mutex.RLock()
+	if rt.prev == nil {
+		defer rt.mutex.RUnlock()
+
+		batches := make(map[string]*dbclient.Batch)
+		var order []string
+		for _, op := range ops {
+			node := rt.ring.node(op.key)
+			b, ok := batches[node]
+			if !ok {
+				b = new(dbclient.Batch)
+				batches[node] = b
+				order = append(order, node)
+			}
+			if op.deleted {
+				b.Delete(op.key)
+			} else {
+				b.Put(op.key, op.value)
+			}
+		}
+		for _, node := range order {
+			if err := rt.clients[node].Batch(ctx, batches[node]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	rt.mutex.RUnlock()
+
+	for _, op := range ops {
+		var err error
+		if op.deleted {
+			err = ignoreNotFound(rt.Delete(ctx, op.key))
+		} else {
+			err = rt.Put(ctx, op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddNode adds node to the ring and moves the keys it now owns in the background.
+func (rt *router) AddNode(node string) error {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	if rt.prev != nil {
+		return errMigrating
+	}
+	if rt.ring.has(node) {
+		return errKnownNode
+	}
+
+	rt.prev = rt.ring
+	rt.ring = rt.ring.with(node)
+	rt.clients[node] = rt.newClient(node)
+
+	rt.migrations.Add(1)
+	go rt.migrate(rt.prev, rt.ring, node)
+	return nil
+}
+
+// migrate moves the keys of the new node from the other nodes, retrying failed nodes
+// until every key has moved.
+func (rt *router) migrate(from, to *ring, node string) {
+	defer rt.migrations.Done()
+	log.Printf("Moving keys to the new node %s", node)
+
+	pending := append([]string(nil), from.nodes...)
+	for len(pending) > 0 {
+		var failed []string
+		for _, src := range pending {
+			if err := rt.migrateFrom(src, to, node); err != nil {
+				log.Printf("Failed to move keys from %s: %s", src, err)
+				failed = append(failed, src)
+			}
+		}
+		if pending = failed; len(pending) > 0 {
+			time.Sleep(rt.retryDelay)
+		}
+	}
+
+	rt.mutex.Lock()
+	rt.prev = nil
+	rt.mutex.Unlock()
+	log.Printf("Finished moving keys to %s, %d moved in total", node, rt.moved.Load())
+}
+
+// migrateFrom moves the keys of node from src, reading the keys of src in pages of
+// migratePage so that the router never holds all of them.
+func (rt *router) migrateFrom(src string, to *ring, node string) error {
+	ctx := context.Background()
+	after := ""
+	for {
+		items, err := rt.clients[src].ScanAfter(ctx, "", after, rt.migratePage)
+		if err != nil {
+			return err
+		}
+		for _, kv := range items {
+			if to.node(kv.Key) != node {
+				continue
+			}
+			if err := rt.move(ctx, kv.Key, rt.clients[src], rt.clients[node]); err != nil {
+				return err
+			}
+		}
+		if len(items) < rt.migratePage {
+			return nil
+		}
+		after = items[len(items)-1].Key
+	}
+}
+
+// move copies key to dst and deletes it from src. The value is read again under the
+// key's lock, as a client may have changed it since the scan.
+func (rt *router) move(ctx context.Context, key string, src, dst *dbclient.Client) error {
+	lock := rt.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	value, err := src.Get(ctx, key)
+	if errors.Is(err, dbclient.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := dst.Put(ctx, key, value); err != nil {
+		return err
+	}
+	if err := ignoreNotFound(src.Delete(ctx, key)); err != nil {
+		return err
+	}
+	rt.moved.Add(1)
+	return nil
+}
+
+// NodeStatus is the response of GET /admin/nodes.
+type NodeStatus struct {
+	Nodes     []string `json:"nodes"`
+	Migrating bool     `json:"migrating"`
+	Moved     int64    `json:"moved"`
+}
+
+func (rt *router) Status() NodeStatus {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	return NodeStatus{
+		Nodes:     append([]string(nil), rt.ring.nodes...),
+		Migrating: rt.prev != nil,
+		Moved:     rt.moved.Load(),
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbserver"
+)
+
+// startNode runs a db node with its own datastore.
+func startNode(t *testing.T) (string, *datastore.Db) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dbrouter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(dbserver.NewHandler(db, nil))
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return server.URL, db
+}
+
+func newTestRouter(nodes ...string) *router {
+	rt := newRouter(newRing(100, nodes...), func(node string) *dbclient.Client {
+		return dbclient.New(node, dbclient.WithRetries(0, 0))
+	})
+	rt.retryDelay = 10 * time.Millisecond
+	// Small pages make migrations read the nodes in several of them.
+	rt.migratePage = 16
+	return rt
+}
+
+func TestRing(t *testing.T) {
+	r := newRing(100, "a", "b", "c")
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		counts[r.node(fmt.Sprintf("key%d", i))]++
+	}
+	for _, node := range r.nodes {
+		if counts[node] < 500 {
+			t.Errorf("Node %s owns only %d of 3000 keys: %v", node, counts[node], counts)
+		}
+	}
+
+	grown := r.with("d")
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if before, after := r.node(key), grown.node(key); before != after && after != "d" {
+			t.Errorf("Key %s moved from %s to %s instead of the new node", key, before, after)
+		}
+	}
+	if len(r.nodes) != 3 {
+		t.Errorf("with changed the original ring: %v", r.nodes)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	addr1, db1 := startNode(t)
+	addr2, db2 := startNode(t)
+	rt := newTestRouter(addr1, addr2)
+	server := httptest.NewServer(newHandler(rt, dbserver.DefaultLimits))
+	defer server.Close()
+	client := dbclient.New(server.URL)
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		if err := client.Put(ctx, fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("partitioning", func(t *testing.T) {
+		items1, _ := db1.Scan("")
+		items2, _ := db2.Scan("")
+		if len(items1) == 0 || len(items2) == 0 || len(items1)+len(items2) != 50 {
+			t.Fatalf("Keys are split %d/%d between the nodes", len(items1), len(items2))
+		}
+		for _, kv := range items1 {
+			if rt.ring.node(kv.Key) != addr1 {
+				t.Errorf("Key %s is stored on the wrong node", kv.Key)
+			}
+		}
+	})
+
+	t.Run("get and delete", func(t *testing.T) {
+		if value, err := client.Get(ctx, "key07"); err != nil || value != "value7" {
+			t.Errorf("Get returned %q, %v", value, err)
+		}
+		if err := client.Delete(ctx, "key07"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Get(ctx, "key07"); !errors.Is(err, dbclient.ErrNotFound) {
+			t.Errorf("Get after delete returned %v", err)
+		}
+		if err := client.Delete(ctx, "key07"); !errors.Is(err, dbclient.ErrNotFound) {
+			t.Errorf("Second delete returned %v", err)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		items, err := client.Scan(ctx, "key1", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 10 || items[0].Key != "key10" || items[9].Key != "key19" {
+			t.Errorf("Unexpected scan result %v", items)
+		}
+
+		items, err = client.Scan(ctx, "", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 5 || items[0].Key != "key00" || items[4].Key != "key04" {
+			t.Errorf("Unexpected limited scan result %v", items)
+		}
+
+		items, err = client.ScanAfter(ctx, "key1", "key15", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 3 || items[0].Key != "key16" || items[2].Key != "key18" {
+			t.Errorf("Unexpected scan result after key15 %v", items)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		b := new(dbclient.Batch)
+		b.Put("key00", "batched")
+		b.Put("key01", "batched")
+		b.Delete("key02")
+		if err := client.Batch(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		items, _ := client.Scan(ctx, "key0", 3)
+		if items[0].Value != "batched" || items[1].Value != "batched" || items[2].Key != "key03" {
+			t.Errorf("Unexpected data after a batch %v", items)
+		}
+	})
+
+	t.Run("media types", func(t *testing.T) {
+		h := newHandler(rt, dbserver.DefaultLimits)
+		serve := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			for i := 0; i+1 < len(header); i += 2 {
+				req.Header.Set(header[i], header[i+1])
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec
+		}
+
+		if rec := serve(http.MethodPut, "/db/text", "plain", "Content-Type", "text/plain"); rec.Code != http.StatusNoContent {
+			t.Fatalf("PUT of text responded with %d: %s", rec.Code, rec.Body)
+		}
+		rec := serve(http.MethodGet, "/db/text", "", "Accept", "text/plain")
+		if rec.Body.String() != "plain" || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Errorf("GET of text responded with %q as %q", rec.Body, rec.Header().Get("Content-Type"))
+		}
+		if rec := serve(http.MethodGet, "/db/text", "", "Accept", "text/html"); rec.Code != http.StatusNotAcceptable {
+			t.Errorf("Expected 406 for an unavailable media type, got %d", rec.Code)
+		}
+
+		get := serve(http.MethodGet, "/db/text", "")
+		head := serve(http.MethodHead, "/db/text", "")
+		if head.Code != http.StatusOK || head.Body.Len() != 0 || head.Header().Get("Content-Length") != get.Header().Get("Content-Length") {
+			t.Errorf("HEAD responded with %d, %d bytes and Content-Length %q", head.Code, head.Body.Len(), head.Header().Get("Content-Length"))
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		h := newHandler(rt, dbserver.Limits{MaxKeySize: 8, MaxBodySize: 64})
+		for _, tc := range []struct {
+			method, target, body string
+			code                 int
+		}{
+			{http.MethodGet, "/db/a/b", "", http.StatusBadRequest},
+			{http.MethodGet, "/db/too-long-key", "", http.StatusBadRequest},
+			{http.MethodPut, "/db/key", `{"value": "` + strings.Repeat("v", 64) + `"}`, http.StatusRequestEntityTooLarge},
+			{http.MethodPost, "/db/_batch", `[{"op": "put", "key": "too-long-key"}]`, http.StatusBadRequest},
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+			if rec.Code != tc.code {
+				t.Errorf("%s %s: got %d, want %d", tc.method, tc.target, rec.Code, tc.code)
+			}
+		}
+		if value, err := client.Get(ctx, "key/with/slashes"); !errors.Is(err, dbclient.ErrNotFound) {
+			t.Errorf("Expected an escaped key to be looked up, got %q, %v", value, err)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		var statusErr *dbclient.StatusError
+		err := client.Txn(ctx, nil, new(dbclient.Batch))
+		if !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotImplemented {
+			t.Errorf("Expected 501 for a transaction, got %v", err)
+		}
+		resp, err := http.Get(server.URL + "/db/_watch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotImplemented {
+			t.Errorf("Expected 501 for a watch, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestAddNode(t *testing.T) {
+	addr1, _ := startNode(t)
+	addr2, _ := startNode(t)
+	addr3, db3 := startNode(t)
+	rt := newTestRouter(addr1, addr2)
+	server := httptest.NewServer(newHandler(rt, dbserver.DefaultLimits))
+	defer server.Close()
+	client := dbclient.New(server.URL)
+	ctx := context.Background()
+
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		want[key] = "old"
+		if err := client.Put(ctx, key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := http.Post(server.URL+"/admin/nodes", "application/json", strings.NewReader(fmt.Sprintf(`{"address":%q}`, addr3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Adding a node got %d", resp.StatusCode)
+	}
+
+	// Clients keep writing while the keys move.
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 200; i += 8 {
+				key := fmt.Sprintf("key%03d", i)
+				var err error
+				if i%3 == 0 {
+					err = client.Delete(ctx, key)
+				} else {
+					err = client.Put(ctx, key, "new")
+				}
+				if err != nil {
+					t.Errorf("Write of %s during migration failed: %s", key, err)
+					continue
+				}
+				mutex.Lock()
+				if i%3 == 0 {
+					delete(want, key)
+				} else {
+					want[key] = "new"
+				}
+				mutex.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	rt.migrations.Wait()
+
+	status := rt.Status()
+	if status.Migrating || len(status.Nodes) != 3 || status.Moved == 0 {
+		t.Errorf("Unexpected status after migration %+v", status)
+	}
+
+	items, err := client.Scan(ctx, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(want) {
+		t.Errorf("Scan returned %d keys, want %d", len(items), len(want))
+	}
+	for _, kv := range items {
+		if want[kv.Key] != kv.Value {
+			t.Errorf("Key %s has %q, want %q", kv.Key, kv.Value, want[kv.Key])
+		}
+	}
+
+	moved, _ := db3.Scan("")
+	if len(moved) == 0 {
+		t.Fatal("No keys were moved to the new node")
+	}
+	for _, kv := range moved {
+		if rt.ring.node(kv.Key) != addr3 {
+			t.Errorf("Key %s is on the new node but is owned by another", kv.Key)
+		}
+	}
+
+	resp, err = http.Post(server.URL+"/admin/nodes", "application/json", strings.NewReader(fmt.Sprintf(`{"address":%q}`, addr3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Adding a known node got %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+var errProblems = errors.New("found damaged records")
+
+func dump(out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	full := fs.Bool("full", false, "print values in full instead of the first 40 bytes")
+	dir, err := parseDir(fs, args)
+	if err != nil {
+		return err
+	}
+	opts, err := keyOptions()
+	if err != nil {
+		return err
+	}
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEGMENT\tOFFSET\tSIZE\tSTATUS\tOP\tKEY\tVALUE")
+	for _, path := range paths {
+		name := filepath.Base(path)
+		err := datastore.WalkSegment(path, func(r datastore.RecordInfo) error {
+			if r.Err == datastore.ErrTornTail {
+				fmt.Fprintf(tw, "%s\t%d\t%d\ttorn\t\t\t\n", name, r.Offset, r.Size)
+				return nil
+			}
+			status, op, value := "ok", "put", r.Value
+			if r.Err == datastore.ErrNoKey {
+				status = "no key"
+			} else if r.Err != nil {
+				status = "bad checksum"
+			}
+			if r.Deleted {
+				op, value = "delete", ""
+			}
+			if !*full && len(value) > 40 {
+				value = value[:40] + "..."
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%q\t%q\n", name, r.Offset, r.Size, status, op, r.Key, value)
+			return nil
+		}, opts...)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// segmentStats counts the bytes of a segment after its header. Live bytes hold the
+// newest value of a key; everything else, including tombstones and damaged records, is
+// dead.
+type segmentStats struct {
+	name       string
+	version    int
+	header     int64
+	records    int
+	live, dead int64
+}
+
+type recordPos struct {
+	segment int
+	size    int64
+	deleted bool
+}
+
+func collectStats(dir string) ([]segmentStats, int, error) {
+	opts, err := keyOptions()
+	if err != nil {
+		return nil, 0, err
+	}
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res := make([]segmentStats, len(paths))
+	newest := make(map[string]recordPos)
+	for i, path := range paths {
+		res[i].name = filepath.Base(path)
+		if res[i].version, res[i].header, err = datastore.SegmentFormat(path); err != nil {
+			return nil, 0, err
+		}
+		err := datastore.WalkSegment(path, func(r datastore.RecordInfo) error {
+			// Counted as dead until it turns out to be the newest record of its key.
+			res[i].dead += r.Size
+			if r.Err == nil {
+				res[i].records++
+				newest[r.Key] = recordPos{segment: i, size: r.Size, deleted: r.Deleted}
+			}
+			return nil
+		}, opts...)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	keys := 0
+	for _, pos := range newest {
+		if pos.deleted {
+			continue
+		}
+		keys++
+		res[pos.segment].live += pos.size
+		res[pos.segment].dead -= pos.size
+	}
+	return res, keys, nil
+}
+
+func stats(out io.Writer, args []string) error {
+	dir, err := parseDir(flag.NewFlagSet("stats", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	segments, keys, err := collectStats(dir)
+	if err != nil {
+		return err
+	}
+
+	var total segmentStats
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SEGMENT\tVERSION\tRECORDS\tLIVE BYTES\tDEAD BYTES\t")
+	for _, s := range segments {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t\n", s.name, s.version, s.records, s.live, s.dead)
+		total.records += s.records
+		total.live += s.live
+		total.dead += s.dead
+	}
+	fmt.Fprintf(tw, "total\t\t%d\t%d\t%d\t\n", total.records, total.live, total.dead)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "\n%d live keys in %d segments\n", keys, len(segments))
+	return err
+}
+
+func verify(out io.Writer, args []string) error {
+	dir, err := parseDir(flag.NewFlagSet("verify", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	opts, err := keyOptions()
+	if err != nil {
+		return err
+	}
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	var records, corrupt int
+	var torn int64
+	for _, path := range paths {
+		name := filepath.Base(path)
+		err := datastore.WalkSegment(path, func(r datastore.RecordInfo) error {
+			switch r.Err {
+			case nil:
+				records++
+			case datastore.ErrTornTail:
+				torn += r.Size
+				fmt.Fprintf(out, "%s @%d: %d bytes of %s\n", name, r.Offset, r.Size, r.Err)
+			default:
+				records++
+				corrupt++
+				fmt.Fprintf(out, "%s @%d: record %q: %s\n", name, r.Offset, r.Key, r.Err)
+			}
+			return nil
+		}, opts...)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(out, "checked %d records in %d segments: %d corrupt, %d bytes of torn tails\n", records, len(paths), corrupt, torn)
+	if corrupt > 0 || torn > 0 {
+		return errProblems
+	}
+	return nil
+}
+
+func dirSize(dir string) (int64, error) {
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		size += stat.Size()
+	}
+	return size, nil
+}
+
+func compact(out io.Writer, args []string) error {
+	dir, err := parseDir(flag.NewFlagSet("compact", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	opts, err := keyOptions()
+	if err != nil {
+		return err
+	}
+	before, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+	if err := datastore.Compact(dir, opts...); err != nil {
+		return err
+	}
+	after, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "compacted %d bytes into %d\n", before, after)
+	return err
+}
+
+func repair(out io.Writer, args []string) error {
+	dir, err := parseDir(flag.NewFlagSet("repair", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	opts, err := keyOptions()
+	if err != nil {
+		return err
+	}
+	results, err := datastore.Repair(dir, opts...)
+	for _, res := range results {
+		fmt.Fprintf(out, "%s: dropped %d corrupt records, cut off %d bytes\n", filepath.Base(res.Path), res.Dropped, res.Truncated)
+	}
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(out, "nothing to repair")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+const usage = `usage: dbtool COMMAND [flags] DIR
+
+Inspects and fixes the segment files of a stopped db.
+
+Commands:
+  dump     print every record with its offset and checksum status
+  stats    print the number of keys and live and dead bytes per segment
+  verify   check the checksums of all records, exit with 1 on problems
+  compact  merge all segments into one
+  repair   drop records with bad checksums and cut off torn tails
+
+Encrypted segments are read with the keys in DB_ENCRYPTION_KEYS, as for the db.
+`
+
+// A command parses its own flags from args and writes its report to out.
+type command func(out io.Writer, args []string) error
+
+var commands = map[string]command{
+	"dump":    dump,
+	"stats":   stats,
+	"verify":  verify,
+	"compact": compact,
+	"repair":  repair,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err := cmd(os.Stdout, os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "dbtool %s: %s\n", os.Args[1], err)
+		if err == errProblems {
+			os.Exit(1)
+		}
+		os.Exit(2)
+	}
+}
+
+// parseDir parses the flags of a command followed by the db directory.
+func parseDir(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("expected the db directory as the only argument")
+	}
+	return fs.Arg(0), nil
+}
+
+// keyOptions returns the options that make the encryption keys of the db available.
+func keyOptions() ([]datastore.Option, error) {
+	keys, err := datastore.ReadKeyring("", "DB_ENCRYPTION_KEYS")
+	if err != nil || keys == nil {
+		return nil, err
+	}
+	return []datastore.Option{datastore.WithEncryption(keys)}, nil
+}
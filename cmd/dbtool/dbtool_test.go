@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+func newTestDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dbtool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := datastore.NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"a", "3"}, {"c", "4"}} {
+		if err := db.Put(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestStats(t *testing.T) {
+	dir := newTestDir(t)
+
+	segments, keys, err := collectStats(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != 2 || len(segments) != 1 {
+		t.Fatalf("Expected 2 keys in 1 segment, got %d in %d", keys, len(segments))
+	}
+	s := segments[0]
+	stat, err := os.Stat(filepath.Join(dir, "current-data0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.records != 5 || s.header+s.live+s.dead != stat.Size() {
+		t.Errorf("Unexpected stats %+v for a file of %d bytes", s, stat.Size())
+	}
+	// The newest a and b, of 42 bytes each.
+	if s.live != 84 {
+		t.Errorf("Expected 84 live bytes, got %d", s.live)
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	dir := newTestDir(t)
+
+	var out bytes.Buffer
+	if err := verify(&out, []string{dir}); err != nil {
+		t.Fatalf("Verify of an intact db failed: %s\n%s", err, out.String())
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "current-data0"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("torn"))
+	f.Close()
+
+	out.Reset()
+	if err := verify(&out, []string{dir}); err != errProblems {
+		t.Errorf("Expected verify to find the torn tail, got %v", err)
+	}
+	if !strings.Contains(out.String(), "4 bytes of torn tails") {
+		t.Errorf("Unexpected verify output:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := repair(&out, []string{dir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(&out, []string{dir}); err != nil {
+		t.Errorf("Verify after repair failed: %s\n%s", err, out.String())
+	}
+
+	out.Reset()
+	if err := dump(&out, []string{dir}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 6 || !strings.Contains(out.String(), `delete  "c"`) {
+		t.Errorf("Unexpected dump:\n%s", out.String())
+	}
+}
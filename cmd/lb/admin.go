@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+)
+
+var adminPort = flag.Int("admin-port", 8091, "load balancer admin API port")
+
+type serverState struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+}
+
+func serverStates() []serverState {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+
+	states := make([]serverState, len(serversPool))
+	for i, server := range serversPool {
+		states[i] = serverState{Address: server, Healthy: healthStatus[server]}
+	}
+	return states
+}
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/admin/servers", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.Header().Set("Allow", http.MethodGet)
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(serverStates())
+	})
+
+	mux.HandleFunc("/admin/limits", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.Header().Set("Allow", http.MethodGet)
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(rateLimiter.state())
+	})
+
+	return mux
+}
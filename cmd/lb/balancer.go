@@ -8,19 +8,24 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/KPI-3-Architecture-Labs/lab4/httptools"
 	"github.com/KPI-3-Architecture-Labs/lab4/signal"
+	"github.com/KPI-3-Architecture-Labs/lab4/tracing"
 )
 
 var (
 	port       = flag.Int("port", 8090, "load balancer port")
 	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
+	author     = flag.String("author", "lb", "balancer name reported to backends in the lb-author header")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	traceExport  = flag.String("trace-export", "", "where to export tracing spans: a file path, \"stdout\" or empty to disable")
 )
 
 var (
@@ -30,9 +35,15 @@ var (
 		"server2:8080",
 		"server3:8080",
 	}
-	healthyPool = make([]string, len(serversPool))
+	healthyPool  = make([]string, len(serversPool))
+	healthStatus = make(map[string]bool)
 
 	poolLock sync.Mutex
+
+	requestCount atomic.Int64
+
+	// client forwards requests to the backends; main sets it up with the tracer.
+	client *http.Client
 )
 
 func scheme() string {
@@ -72,8 +83,15 @@ func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
 	fwdRequest.URL.Host = dst
 	fwdRequest.URL.Scheme = scheme()
 	fwdRequest.Host = dst
+	fwdRequest.Header.Set("lb-author", *author)
+	fwdRequest.Header.Set("lb-req-cnt", strconv.FormatInt(requestCount.Add(1), 10))
+
+	span := tracing.SpanFromContext(ctx)
+	if span != nil {
+		span.SetAttribute("lb.backend", dst)
+	}
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
+	resp, err := client.Do(fwdRequest)
 	if err != nil {
 		log.Printf("Failed to get response from %s: %s", dst, err)
 		rw.WriteHeader(http.StatusServiceUnavailable)
@@ -103,20 +121,41 @@ func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
 func main() {
 	flag.Parse()
 
+	exporter, err := tracing.NewExporter(*traceExport)
+	if err != nil {
+		log.Fatalf("Failed to set up trace export: %s", err)
+	}
+	tracer := tracing.NewTracer("lb", exporter)
+	defer tracer.Close()
+	client = &http.Client{Transport: tracer.Transport(nil)}
+
 	healthCheck(serversPool, healthyPool)
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+	var balancer http.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		serverIndex := getIndex(r.RemoteAddr)
 		dst := getServer(serverIndex)
 		err := forward(dst, rw, r)
 		if err != nil {
 			return
 		}
-	}))
+	})
+	if *rateLimitsFile != "" {
+		config, err := readRateConfig(*rateLimitsFile)
+		if err != nil {
+			log.Fatalf("Failed to read the rate limits: %s", err)
+		}
+		rateLimiter = newLimiter(config, time.Now)
+		balancer = rateLimiter.handler(balancer)
+	}
+
+	frontend := httptools.CreateServer(*port, tracer.Handler(balancer))
+
+	admin := httptools.CreateServer(*adminPort, adminHandler())
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
 	frontend.Start()
+	admin.Start()
 	signal.WaitForTerminationSignal()
 }
 
@@ -136,10 +175,11 @@ func getServer(index int) string {
 
 func healthCheck(servers []string, result []string) {
 
-	healthStatus := make(map[string]bool)
+	poolLock.Lock()
 	for _, server := range servers {
 		healthStatus[server] = true
 	}
+	poolLock.Unlock()
 
 	for i, server := range servers {
 		i := i
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -63,3 +64,25 @@ func (s *TestSuite) TestHealth(c *C) {
 	c.Assert(result[1], Equals, hostURL2)
 	c.Assert(result[2], Equals, "")
 }
+
+func (s *TestSuite) TestAdminServers(c *C) {
+	poolLock.Lock()
+	for i, server := range serversPool {
+		healthStatus[server] = i != 1
+	}
+	poolLock.Unlock()
+
+	rec := httptest.NewRecorder()
+	adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/servers", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	var states []serverState
+	c.Assert(json.NewDecoder(rec.Body).Decode(&states), IsNil)
+	c.Assert(states, HasLen, len(serversPool))
+	c.Assert(states[0], Equals, serverState{Address: serversPool[0], Healthy: true})
+	c.Assert(states[1], Equals, serverState{Address: serversPool[1], Healthy: false})
+
+	rec = httptest.NewRecorder()
+	adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/servers", nil))
+	c.Assert(rec.Code, Equals, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rateLimitsFile = flag.String("rate-limits", "", "JSON file of the rate limits of clients; empty disables rate limiting")
+
+// rateLimiter is nil unless rate limits are configured.
+var rateLimiter *limiter
+
+// rateLimit lets a client make Rate requests per second on average, and up to Burst at once.
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// routeLimit applies to the paths that start with Prefix.
+type routeLimit struct {
+	Prefix string `json:"prefix"`
+	rateLimit
+}
+
+// rateConfig is the format of the -rate-limits file, e.g.
+//
+//	{
+//	  "key_header": "X-API-Key",
+//	  "global": {"rate": 50, "burst": 100},
+//	  "routes": [{"prefix": "/api/v1/some-data", "rate": 10, "burst": 20}]
+//	}
+//
+// Clients are told apart by the value of KeyHeader, or by their IP address when it is
+// empty or missing from a request. Every client gets the Global limit across all
+// routes, and the limit of the longest matching route prefix on top of it.
+type rateConfig struct {
+	KeyHeader string       `json:"key_header,omitempty"`
+	Global    *rateLimit   `json:"global,omitempty"`
+	Routes    []routeLimit `json:"routes,omitempty"`
+}
+
+func readRateConfig(path string) (rateConfig, error) {
+	var config rateConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("malformed rate limits: %w", err)
+	}
+	limits := make([]rateLimit, 0, len(config.Routes)+1)
+	if config.Global != nil {
+		limits = append(limits, *config.Global)
+	}
+	for _, r := range config.Routes {
+		limits = append(limits, r.rateLimit)
+	}
+	for _, l := range limits {
+		if l.Rate <= 0 || l.Burst < 1 {
+			return config, fmt.Errorf("rate limits need a positive rate and burst")
+		}
+	}
+	prefixes := make(map[string]bool)
+	for _, r := range config.Routes {
+		if r.Prefix == "" || prefixes[r.Prefix] {
+			return config, fmt.Errorf("route limits need distinct non-empty prefixes, got %q", r.Prefix)
+		}
+		prefixes[r.Prefix] = true
+	}
+	return config, nil
+}
+
+// bucket holds the tokens of a client for one limit as of last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketKey identifies a bucket by the client and either the route prefix of its limit
+// or global.
+type bucketKey struct {
+	client string
+	route  string
+	global bool
+}
+
+// sweepInterval is how often buckets that have refilled are dropped, so that the number
+// of buckets follows the number of active clients.
+const sweepInterval = time.Minute
+
+// limiter enforces a rateConfig with token buckets.
+type limiter struct {
+	config rateConfig
+	now    func() time.Time
+
+	mutex     sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+	allowed   int64
+	rejected  int64
+}
+
+func newLimiter(config rateConfig, now func() time.Time) *limiter {
+	// The longest matching prefix is the first one.
+	sort.SliceStable(config.Routes, func(i, j int) bool {
+		return len(config.Routes[i].Prefix) > len(config.Routes[j].Prefix)
+	})
+	return &limiter{config: config, now: now, buckets: make(map[bucketKey]*bucket), lastSweep: now()}
+}
+
+// clientKey tells the clients apart by their API key or IP address.
+func (l *limiter) clientKey(r *http.Request) string {
+	if l.config.KeyHeader != "" {
+		if key := r.Header.Get(l.config.KeyHeader); key != "" {
+			return "key:" + key
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// take refills the bucket of key and returns how long until it has a token.
+func (l *limiter) take(key bucketKey, limit rateLimit, now time.Time) (*bucket, time.Duration) {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return b, 0
+	}
+	return b, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// allow takes a token from every bucket that applies to r. If one of them is empty, it
+// takes none and returns how long the client should wait.
+func (l *limiter) allow(r *http.Request) (bool, time.Duration) {
+	client := l.clientKey(r)
+	now := l.now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+
+	var (
+		buckets []*bucket
+		wait    time.Duration
+	)
+	check := func(key bucketKey, limit rateLimit) {
+		b, w := l.take(key, limit, now)
+		buckets = append(buckets, b)
+		if w > wait {
+			wait = w
+		}
+	}
+	if l.config.Global != nil {
+		check(bucketKey{client: client, global: true}, *l.config.Global)
+	}
+	for _, route := range l.config.Routes {
+		if strings.HasPrefix(r.URL.Path, route.Prefix) {
+			check(bucketKey{client: client, route: route.Prefix}, route.rateLimit)
+			break
+		}
+	}
+
+	if wait > 0 {
+		l.rejected++
+		return false, wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	l.allowed++
+	return true, 0
+}
+
+// sweep drops the buckets that are full by now. It is called with the lock held.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		limit := l.limitOf(key)
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *limiter) limitOf(key bucketKey) rateLimit {
+	if key.global {
+		return *l.config.Global
+	}
+	for _, route := range l.config.Routes {
+		if route.Prefix == key.route {
+			return route.rateLimit
+		}
+	}
+	return rateLimit{}
+}
+
+// handler responds with 429 Too Many Requests and a Retry-After header in seconds to the
+// requests of clients over their limits, and passes the rest to next.
+func (l *limiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ok, wait := l.allow(r)
+		if !ok {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(rw, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+type bucketState struct {
+	Client string  `json:"client"`
+	Route  string  `json:"route,omitempty"`
+	Global bool    `json:"global,omitempty"`
+	Tokens float64 `json:"tokens"`
+}
+
+// limiterState is what /admin/limits reports.
+type limiterState struct {
+	Enabled  bool          `json:"enabled"`
+	Config   *rateConfig   `json:"config,omitempty"`
+	Allowed  int64         `json:"allowed"`
+	Rejected int64         `json:"rejected"`
+	Buckets  []bucketState `json:"buckets"`
+}
+
+func (l *limiter) state() limiterState {
+	if l == nil {
+		return limiterState{Buckets: []bucketState{}}
+	}
+	now := l.now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s := limiterState{Enabled: true, Config: &l.config, Allowed: l.allowed, Rejected: l.rejected, Buckets: []bucketState{}}
+	for key, b := range l.buckets {
+		limit := l.limitOf(key)
+		tokens := math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+		s.Buckets = append(s.Buckets, bucketState{Client: key.client, Route: key.route, Global: key.global, Tokens: tokens})
+	}
+	sort.Slice(s.Buckets, func(i, j int) bool {
+		if s.Buckets[i].Client != s.Buckets[j].Client {
+			return s.Buckets[i].Client < s.Buckets[j].Client
+		}
+		if s.Buckets[i].Global != s.Buckets[j].Global {
+			return s.Buckets[i].Global
+		}
+		return s.Buckets[i].Route < s.Buckets[j].Route
+	})
+	return s
+}
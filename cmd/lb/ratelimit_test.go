@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type fakeClock struct{ now time.Time }
+
+func (f *fakeClock) Now() time.Time          { return f.now }
+func (f *fakeClock) Advance(d time.Duration) { f.now = f.now.Add(d) }
+
+func limitedRequest(h http.Handler, remoteAddr, path, apiKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *TestSuite) TestRateLimit(c *C) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := newLimiter(rateConfig{
+		KeyHeader: "X-API-Key",
+		Global:    &rateLimit{Rate: 1, Burst: 2},
+		Routes: []routeLimit{
+			{Prefix: "/api", rateLimit: rateLimit{Rate: 10, Burst: 10}},
+			{Prefix: "/api/v1/some-data", rateLimit: rateLimit{Rate: 0.5, Burst: 1}},
+		},
+	}, clock.Now)
+	h := l.handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	c.Assert(limitedRequest(h, "10.0.0.1:5000", "/", "").Code, Equals, http.StatusOK)
+	c.Assert(limitedRequest(h, "10.0.0.1:5001", "/", "").Code, Equals, http.StatusOK)
+	rec := limitedRequest(h, "10.0.0.1:5002", "/", "")
+	c.Assert(rec.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(rec.Header().Get("Retry-After"), Equals, "1")
+
+	// Other addresses and API keys have buckets of their own.
+	c.Assert(limitedRequest(h, "10.0.0.2:5000", "/", "").Code, Equals, http.StatusOK)
+	c.Assert(limitedRequest(h, "10.0.0.1:5000", "/", "secret").Code, Equals, http.StatusOK)
+
+	clock.Advance(time.Second)
+	c.Assert(limitedRequest(h, "10.0.0.1:5000", "/", "").Code, Equals, http.StatusOK)
+
+	// The longest route prefix applies on top of the global limit, and a rejected request
+	// takes no tokens.
+	c.Assert(limitedRequest(h, "10.0.0.3:5000", "/api/v1/some-data", "").Code, Equals, http.StatusOK)
+	rec = limitedRequest(h, "10.0.0.3:5000", "/api/v1/some-data", "")
+	c.Assert(rec.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(rec.Header().Get("Retry-After"), Equals, "2")
+	c.Assert(limitedRequest(h, "10.0.0.3:5000", "/api/other", "").Code, Equals, http.StatusOK)
+
+	rateLimiter = l
+	defer func() { rateLimiter = nil }()
+	rec = httptest.NewRecorder()
+	adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/limits", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	var state limiterState
+	c.Assert(json.NewDecoder(rec.Body).Decode(&state), IsNil)
+	c.Assert(state.Enabled, Equals, true)
+	c.Assert(state.Allowed, Equals, int64(7))
+	c.Assert(state.Rejected, Equals, int64(2))
+	c.Assert(state.Buckets, HasLen, 6)
+	c.Assert(state.Buckets[0], Equals, bucketState{Client: "ip:10.0.0.1", Global: true, Tokens: 0})
+
+	// Buckets of idle clients are dropped once they refill.
+	clock.Advance(2 * sweepInterval)
+	c.Assert(limitedRequest(h, "10.0.0.1:5000", "/", "").Code, Equals, http.StatusOK)
+	c.Assert(l.state().Buckets, HasLen, 1)
+}
+
+func (s *TestSuite) TestReadRateConfig(c *C) {
+	path := filepath.Join(c.MkDir(), "limits.json")
+	c.Assert(os.WriteFile(path, []byte(`{"global": {"rate": 5, "burst": 10}, "routes": [{"prefix": "/api", "rate": 1, "burst": 2}]}`), 0o600), IsNil)
+	config, err := readRateConfig(path)
+	c.Assert(err, IsNil)
+	c.Assert(*config.Global, Equals, rateLimit{Rate: 5, Burst: 10})
+	c.Assert(config.Routes, DeepEquals, []routeLimit{{Prefix: "/api", rateLimit: rateLimit{Rate: 1, Burst: 2}}})
+
+	for _, config := range []string{
+		`{"routes": [{"prefix": "/api", "rate": 1}]}`,
+		`{"routes": [{"prefix": "", "rate": 1, "burst": 2}]}`,
+		`{"routes": [{"prefix": "/api", "rate": 1, "burst": 2}, {"prefix": "/api", "rate": 2, "burst": 2}]}`,
+	} {
+		c.Assert(os.WriteFile(path, []byte(config), 0o600), IsNil)
+		_, err = readRateConfig(path)
+		c.Assert(err, NotNil, Commentf("config %s", config))
+	}
+}
+
+func (s *TestSuite) TestRateLimitGlobalBucket(c *C) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// The global bucket is separate from the bucket of a route that matches every path.
+	l := newLimiter(rateConfig{
+		Global: &rateLimit{Rate: 1, Burst: 1},
+		Routes: []routeLimit{{Prefix: "", rateLimit: rateLimit{Rate: 1, Burst: 5}}},
+	}, clock.Now)
+	ok, _ := l.allow(req)
+	c.Assert(ok, Equals, true)
+	ok, _ = l.allow(req)
+	c.Assert(ok, Equals, false)
+	c.Assert(l.state().Buckets, DeepEquals, []bucketState{
+		{Client: "ip:192.0.2.1", Global: true, Tokens: 0},
+		{Client: "ip:192.0.2.1", Tokens: 4},
+	})
+
+	// Without a global limit, route buckets are swept and reported without one.
+	l = newLimiter(rateConfig{Routes: []routeLimit{{Prefix: "", rateLimit: rateLimit{Rate: 1, Burst: 2}}}}, clock.Now)
+	ok, _ = l.allow(req)
+	c.Assert(ok, Equals, true)
+	c.Assert(l.state().Buckets, HasLen, 1)
+	clock.Advance(2 * sweepInterval)
+	ok, _ = l.allow(req)
+	c.Assert(ok, Equals, true)
+	c.Assert(l.state().Buckets, HasLen, 1)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+)
+
+const (
+	maxKeyLen   = 256
+	maxBodySize = 1 << 20
+)
+
+// someData serves /api/v1/some-data on top of cmd/db.
+type someData struct {
+	db     *dbclient.Client
+	cache  *cache
+	report *Report
+}
+
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func writeError(rw http.ResponseWriter, status int, message string) {
+	writeJSON(rw, status, map[string]string{"error": message})
+}
+
+func validateKey(key string) error {
+	switch {
+	case key == "":
+		return errors.New("key required")
+	case len(key) > maxKeyLen:
+		return fmt.Errorf("key is longer than %d bytes", maxKeyLen)
+	case strings.Contains(key, "/"):
+		return errors.New("key must not contain '/'")
+	}
+	return nil
+}
+
+func (h *someData) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h.report.Process(r)
+
+	key := r.URL.Query().Get("key")
+	if err := validateKey(key); err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.get(rw, r, key)
+	case http.MethodPut, http.MethodPost:
+		h.put(rw, r, key)
+	case http.MethodDelete:
+		h.delete(rw, r, key)
+	default:
+		rw.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *someData) get(rw http.ResponseWriter, r *http.Request, key string) {
+	value, err := h.cache.Get(r.Context(), key, func(ctx context.Context) (string, error) {
+		return h.db.Get(ctx, key)
+	})
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, record{Key: key, Value: value})
+}
+
+func (h *someData) put(rw http.ResponseWriter, r *http.Request, key string) {
+	var body struct {
+		Value *string `json:"value"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(rw, http.StatusRequestEntityTooLarge, "request body is too large")
+			return
+		}
+		writeError(rw, http.StatusBadRequest, "body must be a JSON object with a string value")
+		return
+	}
+	if body.Value == nil {
+		writeError(rw, http.StatusBadRequest, "value required")
+		return
+	}
+
+	err := h.db.Put(r.Context(), key, *body.Value)
+	h.cache.Invalidate(key)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	writeJSON(rw, http.StatusCreated, record{Key: key, Value: *body.Value})
+}
+
+func (h *someData) delete(rw http.ResponseWriter, r *http.Request, key string) {
+	err := h.db.Delete(r.Context(), key)
+	h.cache.Invalidate(key)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// writeDbError translates a db client error into the API's own error response.
+func writeDbError(rw http.ResponseWriter, err error) {
+	var statusErr *dbclient.StatusError
+	switch {
+	case errors.Is(err, dbclient.ErrNotFound):
+		writeError(rw, http.StatusNotFound, "not found")
+	case errors.Is(err, dbclient.ErrBadRequest) && errors.As(err, &statusErr):
+		message := statusErr.Message
+		if message == "" {
+			message = http.StatusText(statusErr.Code)
+		}
+		writeError(rw, statusErr.Code, message)
+	default:
+		writeError(rw, http.StatusServiceUnavailable, "db is unavailable")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+)
+
+// fakeDb implements the cmd/db /db/ contract on top of a map.
+func fakeDb() *httptest.Server {
+	var mutex sync.Mutex
+	data := make(map[string]string)
+
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		key := strings.TrimPrefix(r.URL.Path, "/db/")
+		switch r.Method {
+		case http.MethodGet:
+			value, ok := data[key]
+			if !ok {
+				writeError(rw, http.StatusNotFound, "Not found")
+				return
+			}
+			writeJSON(rw, http.StatusOK, record{Key: key, Value: value})
+		case http.MethodPut, http.MethodPost:
+			var body struct {
+				Value string `json:"value"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeError(rw, http.StatusBadRequest, "Bad request")
+				return
+			}
+			data[key] = body.Value
+			rw.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			if _, ok := data[key]; !ok {
+				writeError(rw, http.StatusNotFound, "Not found")
+				return
+			}
+			delete(data, key)
+			rw.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func errorMessage(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("Error body is not JSON: %s", err)
+	}
+	return body["error"]
+}
+
+func TestSomeData_ReadWrite(t *testing.T) {
+	db := fakeDb()
+	defer db.Close()
+	h := &someData{db: dbclient.New(db.URL, dbclient.WithRetries(0, 0)), cache: newCache(16, time.Minute), report: NewReport()}
+
+	rec := serve(h, http.MethodGet, "/api/v1/some-data?key=k1", "")
+	if rec.Code != http.StatusNotFound || errorMessage(t, rec) != "not found" {
+		t.Errorf("Unexpected response for a missing key: %d", rec.Code)
+	}
+
+	rec = serve(h, http.MethodPut, "/api/v1/some-data?key=k1", `{"value": "v1"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected put status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(h, http.MethodGet, "/api/v1/some-data?key=k1", "")
+	var got record
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || got != (record{Key: "k1", Value: "v1"}) {
+		t.Errorf("Unexpected get response %d %+v (%v)", rec.Code, got, err)
+	}
+
+	rec = serve(h, http.MethodPost, "/api/v1/some-data?key=k1", `{"value": "v2"}`)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("Unexpected post status %d", rec.Code)
+	}
+
+	rec = serve(h, http.MethodDelete, "/api/v1/some-data?key=k1", "")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Unexpected delete status %d", rec.Code)
+	}
+	rec = serve(h, http.MethodDelete, "/api/v1/some-data?key=k1", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status deleting a missing key: %d", rec.Code)
+	}
+
+	if n := h.report.Stats().Requests; n != 6 {
+		t.Errorf("Expected every request in the report, got %d", n)
+	}
+}
+
+func TestSomeData_Validation(t *testing.T) {
+	db := fakeDb()
+	defer db.Close()
+	h := &someData{db: dbclient.New(db.URL, dbclient.WithRetries(0, 0)), cache: newCache(16, time.Minute), report: NewReport()}
+
+	cases := []struct {
+		method, target, body string
+		status               int
+	}{
+		{http.MethodGet, "/api/v1/some-data", "", http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/some-data?key=a/b", "", http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/some-data?key=" + strings.Repeat("k", maxKeyLen+1), "", http.StatusBadRequest},
+		{http.MethodPut, "/api/v1/some-data?key=k", "", http.StatusBadRequest},
+		{http.MethodPut, "/api/v1/some-data?key=k", `{"value": 1}`, http.StatusBadRequest},
+		{http.MethodPut, "/api/v1/some-data?key=k", `{}`, http.StatusBadRequest},
+		{http.MethodPut, "/api/v1/some-data?key=k", `{"value": "v", "extra": true}`, http.StatusBadRequest},
+		{http.MethodPut, "/api/v1/some-data?key=k", `{"value": "` + strings.Repeat("v", maxBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPatch, "/api/v1/some-data?key=k", "", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		rec := serve(h, c.method, c.target, c.body)
+		if rec.Code != c.status {
+			t.Errorf("%s %.60s: expected %d, got %d", c.method, c.target, c.status, rec.Code)
+		}
+		if errorMessage(t, rec) == "" {
+			t.Errorf("%s %.60s: empty error message", c.method, c.target)
+		}
+	}
+}
+
+func TestSomeData_DbErrors(t *testing.T) {
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			writeError(rw, http.StatusBadRequest, "Bad request")
+			return
+		}
+		writeError(rw, http.StatusInternalServerError, "Internal Server Error")
+	}))
+	h := &someData{db: dbclient.New(db.URL, dbclient.WithRetries(0, 0)), cache: newCache(16, time.Minute), report: NewReport()}
+
+	rec := serve(h, http.MethodPut, "/api/v1/some-data?key=k", `{"value": "v"}`)
+	if rec.Code != http.StatusBadRequest || errorMessage(t, rec) != "Bad request" {
+		t.Errorf("Expected the db 400 to be passed through, got %d", rec.Code)
+	}
+
+	rec = serve(h, http.MethodGet, "/api/v1/some-data?key=k", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for a failing db, got %d", rec.Code)
+	}
+
+	db.Close()
+	rec = serve(h, http.MethodDelete, "/api/v1/some-data?key=k", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for an unreachable db, got %d", rec.Code)
+	}
+}
+
+func TestSomeData_CacheInvalidation(t *testing.T) {
+	db := fakeDb()
+	defer db.Close()
+	h := &someData{db: dbclient.New(db.URL, dbclient.WithRetries(0, 0)), cache: newCache(16, time.Minute), report: NewReport()}
+
+	serve(h, http.MethodPut, "/api/v1/some-data?key=k", `{"value": "v1"}`)
+	for i := 0; i < 3; i++ {
+		serve(h, http.MethodGet, "/api/v1/some-data?key=k", "")
+	}
+	if stats := h.cache.Stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+
+	serve(h, http.MethodPut, "/api/v1/some-data?key=k", `{"value": "v2"}`)
+	rec := serve(h, http.MethodGet, "/api/v1/some-data?key=k", "")
+	var got record
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || got.Value != "v2" {
+		t.Errorf("Expected the write to invalidate the cached value, got %+v", got)
+	}
+
+	serve(h, http.MethodDelete, "/api/v1/some-data?key=k", "")
+	if rec := serve(h, http.MethodGet, "/api/v1/some-data?key=k", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected the delete to invalidate the cached value, got %d", rec.Code)
+	}
+}
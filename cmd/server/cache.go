@@ -0,0 +1,205 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+)
+
+// cache is a read-through LRU cache of db values with a TTL. Concurrent misses for
+// the same key share a single load.
+type cache struct {
+	mutex      sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	lru   *list.List
+	items map[string]*list.Element
+	calls map[string]*call
+
+	hits, misses, collapsed, evictions int64
+}
+
+type cacheEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+type call struct {
+	done  chan struct{}
+	value string
+	err   error
+	// stale is set when the key is invalidated while the load is in flight,
+	// so its result is not cached.
+	stale bool
+}
+
+type CacheStats struct {
+	Entries   int     `json:"entries"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	Collapsed int64   `json:"collapsed"`
+	Evictions int64   `json:"evictions"`
+	HitRatio  float64 `json:"hitRatio"`
+}
+
+// newCache creates a cache of at most maxEntries values; zero disables caching but still
+// collapses concurrent loads.
+func newCache(maxEntries int, ttl time.Duration) *cache {
+	return &cache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		lru:        list.New(),
+		items:      make(map[string]*list.Element),
+		calls:      make(map[string]*call),
+	}
+}
+
+func (c *cache) Get(ctx context.Context, key string, load func(context.Context) (string, error)) (string, error) {
+	c.mutex.Lock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if c.now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.hits++
+			c.mutex.Unlock()
+			return e.value, nil
+		}
+		c.remove(el)
+	}
+	c.misses++
+
+	if cl, ok := c.calls[key]; ok {
+		c.collapsed++
+		c.mutex.Unlock()
+		select {
+		case <-cl.done:
+			return cl.value, cl.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mutex.Unlock()
+
+	// Other callers wait for this load, so it must not be cut short by this caller leaving.
+	cl.value, cl.err = load(context.WithoutCancel(ctx))
+
+	c.mutex.Lock()
+	if c.calls[key] == cl {
+		delete(c.calls, key)
+	}
+	if cl.err == nil && !cl.stale {
+		c.add(key, cl.value)
+	}
+	c.mutex.Unlock()
+	close(cl.done)
+
+	return cl.value, cl.err
+}
+
+// Invalidate drops the cached value of key, including a value that is being loaded.
+func (c *cache) Invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	if cl, ok := c.calls[key]; ok {
+		// Later readers start a fresh load instead of joining one that began before the write.
+		cl.stale = true
+		delete(c.calls, key)
+	}
+}
+
+// Purge drops all cached values and loads in flight.
+func (c *cache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	for key, cl := range c.calls {
+		cl.stale = true
+		delete(c.calls, key)
+	}
+}
+
+// watchDb invalidates cached values as the db reports changes to them. Everything is
+// purged whenever the watch is set up again, as changes in between are not reported.
+// It gives up on a db that does not support watching, leaving the TTL to expire values.
+func (c *cache) watchDb(ctx context.Context, db *dbclient.Client, backoff, maxBackoff time.Duration) {
+	delay := backoff
+	for {
+		err := db.Watch(ctx, "", func() {
+			c.Purge()
+			delay = backoff
+		}, func(e dbclient.Event) {
+			c.Invalidate(e.Key)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, dbclient.ErrBadRequest) || errors.Is(err, dbclient.ErrNotImplemented) {
+			log.Printf("Db at %s does not support watching, cached values expire after the TTL: %s", db.BaseURL(), err)
+			return
+		}
+		log.Printf("Watching the db at %s failed, retrying in %s: %s", db.BaseURL(), delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+func (c *cache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := CacheStats{
+		Entries:   c.lru.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Collapsed: c.collapsed,
+		Evictions: c.evictions,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRatio = float64(c.hits) / float64(total)
+	}
+	return stats
+}
+
+func (c *cache) add(key, value string) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.lru.PushFront(&cacheEntry{key: key, value: value, expires: c.now().Add(c.ttl)})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
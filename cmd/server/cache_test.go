@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbserver"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func constLoader(value string, calls *int) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		*calls++
+		return value, nil
+	}
+}
+
+func TestCache_LRUAndTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c := newCache(2, time.Minute)
+	c.now = clock.Now
+	ctx := context.Background()
+
+	var calls int
+	for _, key := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, err := c.Get(ctx, key, constLoader(key, &calls)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "b" is evicted by "c" because "a" was used more recently.
+	if calls != 4 {
+		t.Errorf("Expected 4 loads, got %d", calls)
+	}
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 4 || stats.Evictions != 2 || stats.Entries != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.HitRatio != 2.0/6 {
+		t.Errorf("Unexpected hit ratio %f", stats.HitRatio)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := c.Get(ctx, "a", constLoader("a", &calls)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 5 {
+		t.Error("Expected an expired value to be loaded again")
+	}
+
+	if _, err := c.Get(ctx, "err", func(context.Context) (string, error) { return "", errors.New("boom") }); err == nil {
+		t.Error("Expected the load error to be returned")
+	}
+	if _, ok := c.items["err"]; ok {
+		t.Error("Failed loads must not be cached")
+	}
+}
+
+func TestCache_Singleflight(t *testing.T) {
+	c := newCache(10, time.Minute)
+	release := make(chan struct{})
+	var loads atomic.Int32
+	load := func(context.Context) (string, error) {
+		loads.Add(1)
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Get(context.Background(), "key", load); err != nil || v != "value" {
+				t.Errorf("Unexpected result %q, %v", v, err)
+			}
+		}()
+	}
+	for c.Stats().Misses < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := loads.Load(); n != 1 {
+		t.Errorf("Expected concurrent misses to share one load, got %d", n)
+	}
+	if n := c.Stats().Collapsed; n != 9 {
+		t.Errorf("Expected 9 collapsed misses, got %d", n)
+	}
+}
+
+func TestCache_InvalidateInFlight(t *testing.T) {
+	c := newCache(10, time.Minute)
+	started, release := make(chan struct{}), make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = c.Get(context.Background(), "key", func(context.Context) (string, error) {
+			close(started)
+			<-release
+			return "old", nil
+		})
+	}()
+	<-started
+	c.Invalidate("key")
+	close(release)
+	<-done
+
+	var calls int
+	if v, _ := c.Get(context.Background(), "key", constLoader("new", &calls)); v != "new" || calls != 1 {
+		t.Errorf("Expected a fresh load after invalidation, got %q", v)
+	}
+}
+
+func TestCache_WatchDb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := httptest.NewServer(dbserver.NewHandler(db, nil))
+	defer srv.Close()
+
+	c := newCache(16, time.Hour)
+	calls := 0
+	c.Get(context.Background(), "stale", constLoader("cached before the watch", &calls))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.watchDb(ctx, dbclient.New(srv.URL), time.Millisecond, time.Millisecond)
+	waitFor(t, func() bool { return c.Stats().Entries == 0 })
+
+	c.Get(context.Background(), "key", constLoader("old", &calls))
+	if err := db.Put("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return c.Stats().Entries == 0 })
+}
+
+func TestCache_WatchDbUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewLSM(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := httptest.NewServer(dbserver.NewHandler(db, nil))
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		newCache(16, time.Hour).watchDb(context.Background(), dbclient.New(srv.URL), time.Millisecond, time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected watchDb to give up on an engine without watching")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the cache to be invalidated")
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+)
+
+const confHealthFailure = "CONF_HEALTH_FAILURE"
+
+// health answers /health. CONF_HEALTH_FAILURE forces a liveness failure; otherwise the
+// server reports not-ready until it has reached the db, and again while probeDb finds
+// the db unavailable.
+type health struct {
+	ready atomic.Bool
+}
+
+func (h *health) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain")
+
+	switch {
+	case os.Getenv(confHealthFailure) == "true":
+		rw.WriteHeader(http.StatusInternalServerError)
+		_, _ = rw.Write([]byte("FAILURE"))
+	case !h.ready.Load():
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte("NOT READY"))
+	default:
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("OK"))
+	}
+}
+
+// waitForDb saves the current date under teamKey, retrying with exponential backoff
+// until the db accepts it or ctx is done, and then marks the server ready.
+func waitForDb(ctx context.Context, db *dbclient.Client, teamKey string, h *health, backoff, maxBackoff time.Duration) {
+	for {
+		err := saveCurrentDate(ctx, db, teamKey)
+		if err == nil {
+			h.ready.Store(true)
+			log.Printf("Connected to the db at %s", db.BaseURL())
+			return
+		}
+		log.Printf("Db at %s is not reachable yet, retrying in %s: %s", db.BaseURL(), backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// probeDb reads teamKey from the db every interval until ctx is done and marks the
+// server not ready while the db is unreachable or fails, and ready once it answers again.
+func probeDb(ctx context.Context, db *dbclient.Client, teamKey string, h *health, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := db.Get(ctx, teamKey)
+		if ctx.Err() != nil {
+			return
+		}
+		ready := dbAnswered(err)
+		if h.ready.Swap(ready) != ready {
+			if ready {
+				log.Printf("Db at %s is available again", db.BaseURL())
+			} else {
+				log.Printf("Db at %s became unavailable, reporting not ready: %s", db.BaseURL(), err)
+			}
+		}
+	}
+}
+
+// dbAnswered reports whether the result of a db call shows a working db: a success or
+// an error response other than ErrUnavailable.
+func dbAnswered(err error) bool {
+	var statusErr *dbclient.StatusError
+	return err == nil || errors.As(err, &statusErr) && !errors.Is(err, dbclient.ErrUnavailable)
+}
+
+func saveCurrentDate(ctx context.Context, db *dbclient.Client, teamKey string) error {
+	currentDate := time.Now().Format("2006-01-02")
+	return db.Put(ctx, teamKey, currentDate)
+}
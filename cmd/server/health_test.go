@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
+)
+
+func healthStatus(h *health) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	return rec.Code
+}
+
+func TestWaitForDb(t *testing.T) {
+	var attempts atomic.Int32
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != http.MethodPut || r.URL.Path != "/db/teamye" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer db.Close()
+
+	h := new(health)
+	if status := healthStatus(h); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready before the db is reached, got %d", status)
+	}
+
+	client := dbclient.New(db.URL, dbclient.WithRetries(0, 0))
+	waitForDb(context.Background(), client, "teamye", h, time.Millisecond, 4*time.Millisecond)
+
+	if n := attempts.Load(); n != 4 {
+		t.Errorf("Expected 4 attempts, got %d", n)
+	}
+	if status := healthStatus(h); status != http.StatusOK {
+		t.Errorf("Expected ready after the db is reached, got %d", status)
+	}
+
+	t.Setenv(confHealthFailure, "true")
+	if status := healthStatus(h); status != http.StatusInternalServerError {
+		t.Errorf("Expected the liveness override to fail health, got %d", status)
+	}
+}
+
+func TestProbeDb(t *testing.T) {
+	var down atomic.Bool
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"key": "teamye", "value": "2024-01-01"}`))
+	}))
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := new(health)
+	h.ready.Store(true)
+	go probeDb(ctx, dbclient.New(db.URL, dbclient.WithRetries(0, 0)), "teamye", h, time.Millisecond)
+
+	waitForStatus := func(want int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); healthStatus(h) != want; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for health %d", want)
+			}
+		}
+	}
+	down.Store(true)
+	waitForStatus(http.StatusServiceUnavailable)
+	down.Store(false)
+	waitForStatus(http.StatusOK)
+}
+
+func TestWaitForDb_Cancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	h := new(health)
+	client := dbclient.New("http://127.0.0.1:1", dbclient.WithRetries(0, 0))
+	waitForDb(ctx, client, "teamye", h, time.Millisecond, 10*time.Millisecond)
+
+	if h.ready.Load() {
+		t.Error("Server must not become ready without the db")
+	}
+}
@@ -4,29 +4,76 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
 )
 
 const reportMaxLen = 100
 
-type Report map[string][]string
+// Report keeps the last request counters seen from every balancer (lb-author).
+// It is safe for concurrent use.
+type Report struct {
+	mutex  sync.Mutex
+	data   map[string][]string
+	counts map[string]int64
+	total  int64
+}
+
+// ReportStats is the summary served on /report/stats.
+type ReportStats struct {
+	Requests int64            `json:"requests"`
+	Authors  map[string]int64 `json:"authors"`
+	Cache    *CacheStats      `json:"cache,omitempty"`
+}
 
-func (r Report) Process(req *http.Request) {
+func NewReport() *Report {
+	return &Report{
+		data:   make(map[string][]string),
+		counts: make(map[string]int64),
+	}
+}
+
+func (r *Report) Process(req *http.Request) {
 	author := req.Header.Get("lb-author")
 	counter := req.Header.Get("lb-req-cnt")
-	log.Printf("GET some-data from [%s] request [%s]", author, counter)
+	log.Printf("%s some-data from [%s] request [%s]", req.Method, author, counter)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.total++
 
 	if len(author) > 0 {
-		list := r[author]
+		r.counts[author]++
+
+		list := r.data[author]
 		list = append(list, counter)
 		if len(list) > reportMaxLen {
 			list = list[len(list)-reportMaxLen:]
 		}
-		r[author] = list
+		r.data[author] = list
 	}
 }
 
-func (r Report) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+func (r *Report) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	r.mutex.Lock()
+	data, err := json.Marshal(r.data)
+	r.mutex.Unlock()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	rw.Header().Set("content-type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(rw).Encode(r)
+	_, _ = rw.Write(data)
+}
+
+func (r *Report) Stats() ReportStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats := ReportStats{Requests: r.total, Authors: make(map[string]int64, len(r.counts))}
+	for author, n := range r.counts {
+		stats.Authors[author] = n
+	}
+	return stats
 }
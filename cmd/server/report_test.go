@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -11,17 +15,17 @@ func TestReport_Process(t *testing.T) {
 	req.Header.Set("lb-author", "test-author")
 	req.Header.Set("lb-req-cnt", "1")
 
-	r := make(Report)
+	r := NewReport()
 
 	r.Process(req)
-	if !reflect.DeepEqual(r["test-author"], []string{"1"}) {
-		t.Errorf("Unexpected report state %s", r)
+	if !reflect.DeepEqual(r.data["test-author"], []string{"1"}) {
+		t.Errorf("Unexpected report state %s", r.data)
 	}
 
 	req.Header.Set("lb-req-cnt", "2")
 	r.Process(req)
-	if !reflect.DeepEqual(r["test-author"], []string{"1", "2"}) {
-		t.Errorf("Unexpected report state %s", r)
+	if !reflect.DeepEqual(r.data["test-author"], []string{"1", "2"}) {
+		t.Errorf("Unexpected report state %s", r.data)
 	}
 
 	req.Header.Set("lb-author", "test-len")
@@ -29,7 +33,43 @@ func TestReport_Process(t *testing.T) {
 		req.Header.Set("lb-req-cnt", "test-len")
 		r.Process(req)
 	}
-	if len(r["test-len"]) != reportMaxLen {
-		t.Errorf("Unexpectd error length: %d", len(r["test-len"]))
+	if len(r.data["test-len"]) != reportMaxLen {
+		t.Errorf("Unexpectd error length: %d", len(r.data["test-len"]))
+	}
+
+	stats := r.Stats()
+	if stats.Requests != 105 || stats.Authors["test-author"] != 2 || stats.Authors["test-len"] != 103 {
+		t.Errorf("Unexpected report stats %+v", stats)
+	}
+}
+
+func TestReport_Concurrent(t *testing.T) {
+	r := NewReport()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("lb-author", fmt.Sprintf("author-%d", i%2))
+				req.Header.Set("lb-req-cnt", strconv.Itoa(j))
+				r.Process(req)
+				r.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/report", nil))
+
+	var data map[string][]string
+	if err := json.NewDecoder(rec.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data["author-0"]) != reportMaxLen || len(data["author-1"]) != reportMaxLen {
+		t.Errorf("Unexpected report lengths: %d, %d", len(data["author-0"]), len(data["author-1"]))
 	}
 }
@@ -1,93 +1,77 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbclient"
 	"github.com/KPI-3-Architecture-Labs/lab4/httptools"
 	"github.com/KPI-3-Architecture-Labs/lab4/signal"
+	"github.com/KPI-3-Architecture-Labs/lab4/tracing"
 	"log"
 	"net/http"
 	"os"
 	"time"
 )
 
-var port = flag.Int("port", 8080, "server port")
-
-const dbUrl = "http://db:8083"
+var (
+	port        = flag.Int("port", 8080, "server port")
+	dbURL       = flag.String("db", envOr("DB_URL", "http://db:8083"), "db address, defaults to $DB_URL")
+	cacheSize   = flag.Int("cache-size", 1024, "maximum number of cached db values, zero disables the cache")
+	cacheTTL    = flag.Duration("cache-ttl", 30*time.Second, "how long a cached db value stays fresh")
+	traceExport = flag.String("trace-export", "", "where to export tracing spans: a file path, \"stdout\" or empty to disable")
+)
 
-const confHealthFailure = "CONF_HEALTH_FAILURE"
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return fallback
+}
 
 func main() {
+	flag.Parse()
 
-	saveCurrentDate(dbUrl, "teamye")
-
-	http.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
-		rw.Header().Set("Content-Type", "text/plain")
-
-		if failConfig := os.Getenv(confHealthFailure); failConfig == "true" {
-
-			rw.WriteHeader(http.StatusInternalServerError)
-			_, _ = rw.Write([]byte("FAILURE"))
-		} else {
-			rw.WriteHeader(http.StatusOK)
-			_, _ = rw.Write([]byte("OK"))
-		}
-
+	exporter, err := tracing.NewExporter(*traceExport)
+	if err != nil {
+		log.Fatalf("Failed to set up trace export: %s", err)
+	}
+	tracer := tracing.NewTracer("server", exporter)
+	defer tracer.Close()
+
+	db := dbclient.New(*dbURL, dbclient.WithHTTPClient(&http.Client{
+		Transport: tracer.Transport(dbclient.NewTransport()),
+		Timeout:   10 * time.Second,
+	}))
+
+	h := new(health)
+	http.Handle("/health", h)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		waitForDb(ctx, db, "teamye", h, 500*time.Millisecond, 30*time.Second)
+		probeDb(ctx, db, "teamye", h, 5*time.Second)
+	}()
+
+	report := NewReport()
+	c := newCache(*cacheSize, *cacheTTL)
+	go c.watchDb(ctx, db, 500*time.Millisecond, 30*time.Second)
+	http.Handle("/report", report)
+	http.HandleFunc("/report/stats", func(rw http.ResponseWriter, _ *http.Request) {
+		stats := report.Stats()
+		cacheStats := c.Stats()
+		stats.Cache = &cacheStats
+		writeJSON(rw, http.StatusOK, stats)
 	})
 
-	http.HandleFunc("/api/v1/some-data", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-
-		if key == "" {
-			http.Error(w, "Key required", http.StatusBadRequest)
-			return
-		}
-
-		resp, err := http.Get(dbUrl + "/db/" + key)
-
-		if err != nil {
-			http.Error(w, "Service is not available", http.StatusServiceUnavailable)
-			return
-		}
-
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusNotFound {
-			http.NotFound(w, r)
-			return
-		}
-
-		var data map[string]string
-		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-			http.Error(w, "Error while decoding response", http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-
-		json.NewEncoder(w).Encode(data)
+	http.Handle("/api/v1/some-data", &someData{
+		db:     db,
+		cache:  c,
+		report: report,
 	})
 
-	server := httptools.CreateServer(*port, nil)
+	server := httptools.CreateServer(*port, tracer.Handler(http.DefaultServeMux))
 	server.Start()
 	time.Sleep(5 * time.Second)
 	signal.WaitForTerminationSignal()
 }
-
-func saveCurrentDate(dbURL, teamKey string) {
-	currentDate := time.Now().Format("2006-01-02")
-	data := map[string]string{
-		"value": currentDate,
-	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		log.Fatal("JSON marshalling error:", err)
-	}
-
-	_, err = http.Post(dbURL+"/db/"+teamKey, "application/json", bytes.NewBuffer(jsonData))
-
-	if err != nil {
-		log.Fatal("Error saving current date:", err)
-	}
-}
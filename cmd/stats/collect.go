@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type serverStats struct {
+	Address   string  `json:"address"`
+	Healthy   bool    `json:"healthy"`
+	Requests  int64   `json:"requests"`
+	Share     float64 `json:"share"`
+	Deviation float64 `json:"deviation"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type snapshot struct {
+	Time    time.Time     `json:"time"`
+	Servers []serverStats `json:"servers"`
+	Total   int64         `json:"total"`
+	// Skew is the coefficient of variation of the request counts of healthy servers:
+	// zero for a perfectly even distribution.
+	Skew float64 `json:"skew"`
+}
+
+type reportStats struct {
+	Requests int64 `json:"requests"`
+}
+
+type lbServer struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+}
+
+type collector struct {
+	client  *http.Client
+	scheme  string
+	lbAdmin string
+	// hosts maps the addresses the balancer reports, which resolve only inside its
+	// network, to addresses this process can reach.
+	hosts   map[string]string
+	targets []string
+}
+
+// reachable returns the address to poll the server at address through.
+func (c *collector) reachable(address string) string {
+	if mapped, ok := c.hosts[address]; ok {
+		return mapped
+	}
+	return address
+}
+
+func (c *collector) collect() (snapshot, error) {
+	servers, err := c.discover()
+	if err != nil {
+		return snapshot{}, err
+	}
+
+	var wg sync.WaitGroup
+	for i := range servers {
+		wg.Add(1)
+		go func(s *serverStats, probeHealth bool) {
+			defer wg.Done()
+			address := c.reachable(s.Address)
+			if probeHealth {
+				s.Healthy = c.health(address)
+			}
+			var stats reportStats
+			if err := c.getJSON(fmt.Sprintf("%s://%s/report/stats", c.scheme, address), &stats); err != nil {
+				s.Error = err.Error()
+				return
+			}
+			s.Requests = stats.Requests
+		}(&servers[i], c.lbAdmin == "")
+	}
+	wg.Wait()
+
+	return summarize(time.Now(), servers), nil
+}
+
+// discover returns the servers to poll, asking the balancer admin API when it is configured.
+func (c *collector) discover() ([]serverStats, error) {
+	if c.lbAdmin == "" {
+		servers := make([]serverStats, len(c.targets))
+		for i, t := range c.targets {
+			servers[i].Address = t
+		}
+		return servers, nil
+	}
+
+	// The admin API of the balancer is plain HTTP even when -https is set for the backends.
+	var list []lbServer
+	if err := c.getJSON(fmt.Sprintf("http://%s/admin/servers", c.lbAdmin), &list); err != nil {
+		return nil, fmt.Errorf("discovery through %s failed: %w", c.lbAdmin, err)
+	}
+	servers := make([]serverStats, len(list))
+	for i, s := range list {
+		servers[i] = serverStats{Address: s.Address, Healthy: s.Healthy}
+	}
+	return servers, nil
+}
+
+func (c *collector) health(address string) bool {
+	resp, err := c.client.Get(fmt.Sprintf("%s://%s/health", c.scheme, address))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (c *collector) getJSON(url string, v interface{}) error {
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func summarize(now time.Time, servers []serverStats) snapshot {
+	snap := snapshot{Time: now, Servers: servers}
+
+	var healthy []int64
+	for _, s := range servers {
+		snap.Total += s.Requests
+		if s.Healthy {
+			healthy = append(healthy, s.Requests)
+		}
+	}
+	if len(healthy) == 0 {
+		return snap
+	}
+
+	var sum float64
+	for _, n := range healthy {
+		sum += float64(n)
+	}
+	mean := sum / float64(len(healthy))
+
+	for i := range snap.Servers {
+		s := &snap.Servers[i]
+		if snap.Total > 0 {
+			s.Share = float64(s.Requests) / float64(snap.Total)
+		}
+		if s.Healthy && mean > 0 {
+			s.Deviation = (float64(s.Requests) - mean) / mean
+		}
+	}
+
+	if mean > 0 {
+		var variance float64
+		for _, n := range healthy {
+			variance += (float64(n) - mean) * (float64(n) - mean)
+		}
+		snap.Skew = math.Sqrt(variance/float64(len(healthy))) / mean
+	}
+	return snap
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	snap := summarize(time.Now(), []serverStats{
+		{Address: "a", Healthy: true, Requests: 30},
+		{Address: "b", Healthy: true, Requests: 10},
+		{Address: "c", Healthy: false, Requests: 0},
+	})
+
+	if snap.Total != 40 {
+		t.Errorf("Unexpected total %d", snap.Total)
+	}
+	if snap.Servers[0].Share != 0.75 || snap.Servers[1].Share != 0.25 {
+		t.Errorf("Unexpected shares %+v", snap.Servers)
+	}
+	if snap.Servers[0].Deviation != 0.5 || snap.Servers[1].Deviation != -0.5 || snap.Servers[2].Deviation != 0 {
+		t.Errorf("Unexpected deviations %+v", snap.Servers)
+	}
+	if math.Abs(snap.Skew-0.5) > 1e-9 {
+		t.Errorf("Unexpected skew %f", snap.Skew)
+	}
+}
+
+func backend(requests int64, healthy bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			if !healthy {
+				rw.WriteHeader(http.StatusInternalServerError)
+			}
+		case "/report/stats":
+			fmt.Fprintf(rw, `{"requests": %d}`, requests)
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+}
+
+func TestCollect(t *testing.T) {
+	s1 := backend(5, true)
+	defer s1.Close()
+	s2 := backend(15, false)
+	defer s2.Close()
+
+	c := &collector{
+		client:  http.DefaultClient,
+		scheme:  "http",
+		targets: []string{strings.TrimPrefix(s1.URL, "http://"), strings.TrimPrefix(s2.URL, "http://")},
+	}
+	snap, err := c.collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.Servers[0].Healthy || snap.Servers[1].Healthy {
+		t.Errorf("Unexpected health %+v", snap.Servers)
+	}
+	if snap.Total != 20 || snap.Servers[1].Requests != 15 {
+		t.Errorf("Unexpected counts %+v", snap)
+	}
+
+	// The balancer reports servers by names of its own network.
+	lb := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(rw).Encode([]lbServer{{Address: "server1:8080", Healthy: true}, {Address: c.targets[1], Healthy: false}})
+	}))
+	defer lb.Close()
+
+	c.lbAdmin = strings.TrimPrefix(lb.URL, "http://")
+	c.hosts, err = parseHosts("server1:8080=" + c.targets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err = c.collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Servers) != 2 || snap.Servers[0].Address != "server1:8080" || snap.Servers[0].Requests != 5 || snap.Servers[1].Requests != 15 {
+		t.Errorf("Unexpected discovered servers %+v", snap.Servers)
+	}
+	c.scheme = "https"
+	if _, err := c.discover(); err != nil {
+		t.Errorf("Expected discovery over plain HTTP with HTTPS backends, got %v", err)
+	}
+	if _, err := parseHosts("server1:8080"); err == nil {
+		t.Error("Expected an error for a mapping without an address")
+	}
+}
+
+func TestRenderCSV(t *testing.T) {
+	var out bytes.Buffer
+	r, err := newRenderer("csv", &out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := summarize(time.Unix(0, 0).UTC(), []serverStats{{Address: "a", Healthy: true, Requests: 3}})
+	for i := 0; i < 2; i++ {
+		if err := r.render(snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "time,server") {
+		t.Errorf("Unexpected csv output:\n%s", out.String())
+	}
+	if lines[1] != "1970-01-01T00:00:00Z,a,true,3,1.0000,0.0000," {
+		t.Errorf("Unexpected csv row %q", lines[1])
+	}
+
+	if _, err := newRenderer("xml", &out, false); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
@@ -1,23 +1,27 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
-var https = flag.Bool("https", false, "whether backends support HTTPs")
+// defaultHosts maps the servers of docker-compose, which the balancer knows by their
+// names on the compose network, to the ports published on the host.
+const defaultHosts = "server1:8080=localhost:8080,server2:8080=localhost:8081,server3:8080=localhost:8082"
 
-var serversPool = []string{
-	"localhost:8080",
-	"localhost:8081",
-	"localhost:8082",
-}
-
-type report map[string][]string
+var (
+	https    = flag.Bool("https", false, "whether backends support HTTPs")
+	targets  = flag.String("targets", "localhost:8080,localhost:8081,localhost:8082", "comma separated list of servers to poll")
+	lbAdmin  = flag.String("lb-admin", "", "balancer admin address to discover servers from instead of -targets")
+	hosts    = flag.String("hosts", defaultHosts, "comma separated NAME=ADDRESS pairs that map the servers -lb-admin reports to addresses reachable from here")
+	interval = flag.Duration("interval", 0, "refresh interval; zero prints a single snapshot and exits")
+	format   = flag.String("format", "table", "output format: table, json or csv")
+)
 
 func scheme() string {
 	if *https {
@@ -26,37 +30,65 @@ func scheme() string {
 	return "http"
 }
 
-func main()  {
+func main() {
 	flag.Parse()
 
-	client := new(http.Client)
-	client.Timeout = 10 * time.Second
-
-	res := make([]report, len(serversPool))
-	for i, s := range serversPool {
-		resp, err := client.Get(fmt.Sprintf("%s://%s/report", scheme(), s))
-		if err == nil {
-			var data report
-			if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-				//log.Printf("error parsing froom %s: %s", s, err)
-			} else {
-				for k, v := range data {
-					l := len(v)
-					if l > 5 {
-						l = 5
-					}
-					data[k] = v[len(v)-l:]
-				}
-				res[i] = data
-			}
-		} else {
-			log.Printf("error %s %s", s, err)
+	r, err := newRenderer(*format, os.Stdout, *interval > 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	hostMap, err := parseHosts(*hosts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &collector{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		scheme:  scheme(),
+		lbAdmin: *lbAdmin,
+		hosts:   hostMap,
+		targets: splitTargets(*targets),
+	}
+
+	for {
+		snap, err := c.collect()
+		if err != nil {
+			log.Printf("Failed to collect stats: %s", err)
+		} else if err := r.render(snap); err != nil {
+			log.Fatalf("Failed to render stats: %s", err)
 		}
 
-		log.Println("=========================")
-		log.Println("SERVER", i, serversPool[i])
-		log.Println("=========================")
-		data, _ := json.MarshalIndent(res[i], "", "  ")
-		log.Println(string(data))
+		if *interval <= 0 {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func splitTargets(list string) []string {
+	var res []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// parseHosts parses the NAME=ADDRESS pairs of -hosts.
+func parseHosts(list string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, pair := range splitTargets(list) {
+		name, address, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || address == "" {
+			return nil, fmt.Errorf("bad host mapping %q, expected NAME=ADDRESS", pair)
+		}
+		res[name] = address
 	}
+	return res, nil
 }
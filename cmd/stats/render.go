@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+type renderer struct {
+	format  string
+	out     io.Writer
+	refresh bool
+
+	csv           *csv.Writer
+	headerWritten bool
+}
+
+func newRenderer(format string, out io.Writer, refresh bool) (*renderer, error) {
+	r := &renderer{format: format, out: out, refresh: refresh}
+	switch format {
+	case "table", "json":
+	case "csv":
+		r.csv = csv.NewWriter(out)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return r, nil
+}
+
+func (r *renderer) render(snap snapshot) error {
+	switch r.format {
+	case "json":
+		return json.NewEncoder(r.out).Encode(snap)
+	case "csv":
+		return r.renderCSV(snap)
+	}
+	return r.renderTable(snap)
+}
+
+func (r *renderer) renderTable(snap snapshot) error {
+	if r.refresh {
+		// Clear the terminal and move the cursor home before redrawing.
+		fmt.Fprint(r.out, "\033[H\033[2J")
+	}
+	fmt.Fprintf(r.out, "%s  total requests: %d  skew: %.1f%%\n\n", snap.Time.Format(time.TimeOnly), snap.Total, snap.Skew*100)
+
+	w := tabwriter.NewWriter(r.out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "SERVER\tHEALTH\tREQUESTS\tSHARE\tDEVIATION\t")
+	for _, s := range snap.Servers {
+		health := "up"
+		if !s.Healthy {
+			health = "DOWN"
+		}
+		requests := strconv.FormatInt(s.Requests, 10)
+		if s.Error != "" {
+			requests = "n/a"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.1f%%\t%+.1f%%\t\n", s.Address, health, requests, s.Share*100, s.Deviation*100)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, s := range snap.Servers {
+		if s.Error != "" {
+			fmt.Fprintf(r.out, "\n%s: %s", s.Address, s.Error)
+		}
+	}
+	_, err := fmt.Fprintln(r.out)
+	return err
+}
+
+func (r *renderer) renderCSV(snap snapshot) error {
+	if !r.headerWritten {
+		if err := r.csv.Write([]string{"time", "server", "healthy", "requests", "share", "deviation", "error"}); err != nil {
+			return err
+		}
+		r.headerWritten = true
+	}
+	for _, s := range snap.Servers {
+		err := r.csv.Write([]string{
+			snap.Time.Format(time.RFC3339),
+			s.Address,
+			strconv.FormatBool(s.Healthy),
+			strconv.FormatInt(s.Requests, 10),
+			strconv.FormatFloat(s.Share, 'f', 4, 64),
+			strconv.FormatFloat(s.Deviation, 'f', 4, 64),
+			s.Error,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	r.csv.Flush()
+	return r.csv.Error()
+}
@@ -0,0 +1,17 @@
+package datastore
+
+// WriteBatch collects puts and deletes to be applied atomically by Db.Write.
+// Unlike Db.Delete, a delete in a batch succeeds whether or not the key exists.
+type WriteBatch struct {
+	entries []entry
+}
+
+func (b *WriteBatch) Put(key, value string) {
+	b.entries = append(b.entries, entry{key: key, value: value})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, entry{key: key, deleted: true})
+}
+
+func (b *WriteBatch) Len() int { return len(b.entries) }
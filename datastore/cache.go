@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheEntryOverhead approximates the memory a cached record takes besides its value.
+const cacheEntryOverhead = 96
+
+type cacheKey struct {
+	segment *FileSegment
+	offset  int64
+}
+
+type cachedRecord struct {
+	key     cacheKey
+	value   string
+	deleted bool
+}
+
+// recordCache keeps recently read records in memory, evicting the least recently used
+// ones above its capacity in bytes. Records are keyed by their position in a segment,
+// and segment files are append-only, so a cached record never goes stale: a Put writes
+// the new value at a new position. Entries of segments replaced by compaction are purged.
+// A nil *recordCache is a valid, disabled cache.
+type recordCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+	items    map[cacheKey]*list.Element
+}
+
+func newRecordCache(capacity int64) *recordCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &recordCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[cacheKey]*list.Element),
+	}
+}
+
+func (c *recordCache) get(segment *FileSegment, offset int64) (value string, deleted, ok bool) {
+	if c == nil {
+		return "", false, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.items[cacheKey{segment, offset}]
+	if !ok {
+		return "", false, false
+	}
+	c.lru.MoveToFront(el)
+	r := el.Value.(*cachedRecord)
+	return r.value, r.deleted, true
+}
+
+func (c *recordCache) add(segment *FileSegment, offset int64, value string, deleted bool) {
+	if c == nil {
+		return
+	}
+	size := int64(len(value)) + cacheEntryOverhead
+	if size > c.capacity {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := cacheKey{segment, offset}
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	c.items[key] = c.lru.PushFront(&cachedRecord{key: key, value: value, deleted: deleted})
+	c.size += size
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// purge drops every record of the segment.
+func (c *recordCache) purge(segment *FileSegment) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, el := range c.items {
+		if key.segment == segment {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *recordCache) remove(el *list.Element) {
+	r := c.lru.Remove(el).(*cachedRecord)
+	delete(c.items, r.key)
+	c.size -= int64(len(r.value)) + cacheEntryOverhead
+}
@@ -0,0 +1,329 @@
+package datastore
+
+import (
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// CompactionPolicy chooses the sealed segments to merge. It gets them oldest first and
+// returns the bounds of a run of consecutive segments; an empty run skips compaction.
+type CompactionPolicy interface {
+	Pick(sealed []SegmentInfo) (from, to int)
+}
+
+// SizeTiered merges at least MinSegments consecutive segments of similar size: the
+// largest of them is at most Ratio times the smallest. Every record is rewritten only
+// a few times, while the number of segments grows with the log of the data size.
+type SizeTiered struct {
+	MinSegments int
+	Ratio       float64
+}
+
+func (p SizeTiered) Pick(sealed []SegmentInfo) (int, int) {
+	for from := range sealed {
+		min, max := sealed[from].Size, sealed[from].Size
+		to := from + 1
+		for ; to < len(sealed); to++ {
+			size := sealed[to].Size
+			if size < min {
+				min = size
+			}
+			if size > max {
+				max = size
+			}
+			if float64(max) > p.Ratio*float64(min) {
+				break
+			}
+		}
+		if to-from >= p.MinSegments {
+			return from, to
+		}
+	}
+	return 0, 0
+}
+
+// GarbageRatio rewrites the oldest run of consecutive segments in which at least
+// Threshold of the bytes are dead.
+type GarbageRatio struct {
+	Threshold float64
+}
+
+func (p GarbageRatio) Pick(sealed []SegmentInfo) (int, int) {
+	from := -1
+	for i, s := range sealed {
+		garbage := s.Size == s.Start || float64(s.Dead) >= p.Threshold*float64(s.Size)
+		if garbage && from < 0 {
+			from = i
+		}
+		if !garbage && from >= 0 {
+			return from, i
+		}
+	}
+	if from >= 0 {
+		return from, len(sealed)
+	}
+	return 0, 0
+}
+
+// mergeAll is the policy of a manual compaction.
+type mergeAll struct{}
+
+func (mergeAll) Pick(sealed []SegmentInfo) (int, int) { return 0, len(sealed) }
+
+// outdatedFormat picks the oldest run of consecutive segments in an older format.
+type outdatedFormat struct{}
+
+func (outdatedFormat) Pick(sealed []SegmentInfo) (int, int) {
+	from := -1
+	for i, s := range sealed {
+		old := s.Version < segmentVersion
+		if old && from < 0 {
+			from = i
+		}
+		if !old && from >= 0 {
+			return from, i
+		}
+	}
+	if from >= 0 {
+		return from, len(sealed)
+	}
+	return 0, 0
+}
+
+// WithCompactionPolicy replaces the default SizeTiered{MinSegments: 4, Ratio: 2} policy.
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(o *options) { o.policy = policy }
+}
+
+// WithCompactionRate limits how many bytes per second compaction writes, so that it
+// leaves disk bandwidth to reads and writes. Zero means no limit.
+func WithCompactionRate(bytesPerSec int64) Option {
+	return func(o *options) { o.compactionRate = bytesPerSec }
+}
+
+// throttle slows a compaction down to rate bytes per second.
+type throttle struct {
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+func (t *throttle) wait(n int) {
+	if t == nil || t.rate <= 0 {
+		return
+	}
+	t.written += int64(n)
+	ahead := time.Duration(float64(t.written)/float64(t.rate)*float64(time.Second)) - time.Since(t.start)
+	if ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+// maybeCompact runs the policy in the background unless a compaction is in progress.
+// It is called with the index lock held.
+func (db *Db) maybeCompact() {
+	if !db.compactMutex.TryLock() {
+		return
+	}
+	db.compactions.Add(1)
+	go func() {
+		defer db.compactions.Done()
+		defer db.compactMutex.Unlock()
+		if err := db.compact(db.policy); err != nil {
+			log.Printf("Failed to merge segments: %s", err)
+		}
+	}()
+}
+
+// Compact merges all sealed segments now, after a compaction in progress completes.
+func (db *Db) Compact() error {
+	db.compactMutex.Lock()
+	defer db.compactMutex.Unlock()
+	return db.compact(mergeAll{})
+}
+
+// compact merges the segments chosen by policy. It reads them without holding the index
+// lock, as nothing writes to sealed segments, and swaps the result in only once it is
+// complete. The merged file replaces the newest of the merged ones, so segment file
+// numbers keep the order of the data after a restart.
+func (db *Db) compact(policy CompactionPolicy) error {
+	db.indexMutex.RLock()
+	sealed := append([]*FileSegment(nil), db.segments[:len(db.segments)-1]...)
+	infos := make([]SegmentInfo, len(sealed))
+	for i, s := range sealed {
+		infos[i] = s.info()
+	}
+	// Snapshots taken later read at least the newest records of the run.
+	pinned := db.pinnedSeqs()
+	db.indexMutex.RUnlock()
+
+	from, to := policy.Pick(infos)
+	if to <= from {
+		// Segments in an older format are migrated even if the policy merges nothing.
+		from, to = outdatedFormat{}.Pick(infos)
+	}
+	if to <= from {
+		return nil
+	}
+	run := sealed[from:to]
+
+	db.indexMutex.Lock()
+	id := db.totalNumber
+	db.totalNumber++
+	db.indexMutex.Unlock()
+
+	last := run[len(run)-1]
+	tmpPath := last.outPath + mergeSuffix
+	// Older segments may still hold values that the tombstones of the run hide.
+	newSegment, err := mergeSegments(run, sealed[to:], from > 0, pinned, db.codec, id, tmpPath, newThrottle(db.compactionRate))
+	if err == nil {
+		newSegment.seal(db.compactIndex)
+	}
+
+	db.indexMutex.Lock()
+	// Readers open segments by path, so the file is replaced only together with the index.
+	if err == nil {
+		err = os.Rename(tmpPath, last.outPath)
+	}
+	if err == nil {
+		newSegment.outPath = last.outPath
+		// Only compaction removes segments, so the run is still in the same place.
+		newer := db.segments[to:]
+		newSegment.countLive(newer)
+		segments := make([]*FileSegment, 0, from+1+len(newer))
+		segments = append(segments, db.segments[:from]...)
+		segments = append(segments, newSegment)
+		db.segments = append(segments, newer...)
+	}
+	db.indexMutex.Unlock()
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Readers hold the index lock while they use a segment, so none can see the old ones now.
+	for _, s := range run {
+		db.cache.purge(s)
+		if s != last {
+			os.Remove(s.outPath)
+		}
+	}
+	return nil
+}
+
+func indexed(segments []*FileSegment, key string) bool {
+	for _, s := range segments {
+		if _, ok := s.lookup(key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeSegments writes the newest record of every key of segments to outPath, skipping
+// keys that newer segments override, along with the older records that snapshots at the
+// sequence numbers pinned read. Records are written again with codec, so compaction
+// also compresses or encrypts them with the current settings and key, and migrates
+// them to the current segment format.
+func mergeSegments(segments, newer []*FileSegment, keepTombstones bool, pinned []uint64, codec recordCodec, id int, outPath string, t *throttle) (*FileSegment, error) {
+	newSegment := &FileSegment{
+		id:      id,
+		outPath: outPath,
+		index:   make(hashInd),
+		version: segmentVersion,
+		keyID:   codec.keyID,
+		aead:    codec.aead,
+	}
+
+	f, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := newSegmentHeader(codec.keyID).encode()
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+	offset := int64(len(header))
+	newSegment.start = offset
+
+	for i, s := range segments {
+		s.forEach(func(key string, _ recordPos) {
+			if err != nil || indexed(segments[i+1:], key) {
+				return
+			}
+
+			type version struct {
+				segment *FileSegment
+				pos     recordPos
+			}
+			var all, kept []version
+			for _, older := range segments[:i+1] {
+				for _, pos := range older.versions(key) {
+					all = append(all, version{older, pos})
+				}
+			}
+			next := firstSeq(newer, key)
+			for j, v := range all {
+				if j+1 < len(all) && visible(pinned, v.pos.seq, all[j+1].pos.seq) ||
+					j+1 == len(all) && (next == math.MaxUint64 || visible(pinned, v.pos.seq, next)) {
+					kept = append(kept, v)
+				}
+			}
+			// Without older segments, a tombstone before any value hides nothing.
+			for !keepTombstones && len(kept) > 0 && kept[0].pos.deleted {
+				kept = kept[1:]
+			}
+
+			for j, v := range kept {
+				e := entry{key: key, deleted: v.pos.deleted, seq: v.pos.seq}
+				if !e.deleted {
+					if e.value, err = v.segment.getValue(v.pos.offset); err != nil {
+						return
+					}
+				}
+
+				var n int
+				if n, err = f.Write(e.encode(codec)); err != nil {
+					return
+				}
+				pos := recordPos{offset: offset, size: int64(n), deleted: e.deleted, seq: e.seq}
+				if j+1 < len(kept) {
+					if newSegment.history == nil {
+						newSegment.history = make(map[string][]recordPos)
+					}
+					newSegment.history[key] = append(newSegment.history[key], pos)
+				} else {
+					newSegment.index[key] = pos
+				}
+				offset += int64(n)
+				t.wait(n)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	newSegment.size = offset
+	newSegment.countLive(newer)
+
+	return newSegment, nil
+}
+
+// countLive recounts the live bytes of the segment given the segments written after it.
+func (s *FileSegment) countLive(newer []*FileSegment) {
+	s.live = 0
+	s.forEach(func(key string, pos recordPos) {
+		if !pos.deleted && !indexed(newer, key) {
+			s.live += pos.size
+		}
+	})
+}
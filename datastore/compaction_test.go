@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runPolicy merges a fixed run of segments once there are enough of them.
+type runPolicy struct{ from, to int }
+
+func (p runPolicy) Pick(sealed []SegmentInfo) (int, int) {
+	if len(sealed) < p.to {
+		return 0, 0
+	}
+	return p.from, p.to
+}
+
+func newTestDb(t *testing.T, segmentSize int64, opts ...Option) *Db {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDb(dir, segmentSize, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return db
+}
+
+func totalLive(db *Db) (live, size int64) {
+	for _, s := range db.Segments() {
+		live += s.Live
+		size += s.Size
+	}
+	return live, size
+}
+
+func TestLiveBytes(t *testing.T) {
+	db := newTestDb(t, 1<<20, WithCompactionPolicy(runPolicy{0, 100}))
+
+	recordSize := int64(len((&entry{key: "key0", value: "value0", seq: 1}).Encode()))
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if live, size := totalLive(db); live != 5*recordSize || size != live+db.segments[0].start {
+		t.Errorf("Expected all %d bytes live, got %d of %d", 5*recordSize, live, size)
+	}
+
+	if err := db.Put("key0", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	live, size := totalLive(db)
+	if live != 4*recordSize {
+		t.Errorf("Expected %d live bytes after an overwrite and a delete, got %d", 4*recordSize, live)
+	}
+
+	db.Close()
+	reopened, err := NewDb(db.dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if l, s := totalLive(reopened); l != live || s != size {
+		t.Errorf("Reopened db counts %d live of %d bytes, want %d of %d", l, s, live, size)
+	}
+}
+
+func TestCompactionPolicies(t *testing.T) {
+	sizes := func(sizes ...int64) []SegmentInfo {
+		res := make([]SegmentInfo, len(sizes))
+		for i, size := range sizes {
+			res[i] = SegmentInfo{ID: i, Size: size}
+		}
+		return res
+	}
+
+	tiered := SizeTiered{MinSegments: 3, Ratio: 2}
+	for _, tc := range []struct {
+		sealed   []SegmentInfo
+		from, to int
+	}{
+		{sizes(100, 100), 0, 0},
+		{sizes(100, 120, 90), 0, 3},
+		{sizes(1000, 100, 120, 90, 80), 1, 5},
+		{sizes(1000, 100, 300, 90), 0, 0},
+	} {
+		if from, to := tiered.Pick(tc.sealed); from != tc.from || to != tc.to {
+			t.Errorf("SizeTiered picked [%d, %d) of %v, want [%d, %d)", from, to, tc.sealed, tc.from, tc.to)
+		}
+	}
+
+	sealed := sizes(100, 100, 100, 100)
+	sealed[1].Dead, sealed[2].Dead, sealed[3].Dead = 60, 50, 10
+	if from, to := (GarbageRatio{Threshold: 0.5}).Pick(sealed); from != 1 || to != 3 {
+		t.Errorf("GarbageRatio picked [%d, %d), want [1, 3)", from, to)
+	}
+	if from, to := (GarbageRatio{Threshold: 0.9}).Pick(sealed); from != to {
+		t.Errorf("GarbageRatio picked [%d, %d) without garbage", from, to)
+	}
+}
+
+func TestCompactRun(t *testing.T) {
+	// Merge the second and third segments only, so their tombstones still matter.
+	db := newTestDb(t, 150, WithCompactionPolicy(runPolicy{1, 3}))
+
+	if err := db.Put("deleted", "old value"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 {
+			if err := db.Delete("deleted"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	db.compactions.Wait()
+
+	if _, err := db.Get("deleted"); err != ErrNotFound {
+		t.Errorf("Expected the key deleted in a merged segment to stay deleted, got %v", err)
+	}
+	expected, err := db.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := len(db.Segments())
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	segments := db.Segments()
+	if len(segments) != 2 || before <= 2 {
+		t.Errorf("Expected a manual compaction to leave 2 of %d segments, got %+v", before, segments)
+	}
+	for key, pos := range db.segments[0].index {
+		if pos.deleted {
+			t.Errorf("Expected the tombstone of %s to be dropped by a full merge", key)
+		}
+	}
+	res, err := db.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Compaction changed the data from %v to %v", expected, res)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	start := time.Now()
+	th := newThrottle(10000)
+	for i := 0; i < 10; i++ {
+		th.wait(100)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Writing 1000 bytes at 10000 bytes/s took only %s", elapsed)
+	}
+}
@@ -0,0 +1,123 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNoKey is reported for an encrypted record when its key is not in the keyring.
+var ErrNoKey = fmt.Errorf("record is encrypted with an unavailable key")
+
+// ErrWrongKey is returned when a segment does not decrypt with the key of its ID.
+var ErrWrongKey = fmt.Errorf("segment does not decrypt with key")
+
+// Keyring holds AES-GCM keys by ID. New segments are encrypted with the current key;
+// the others decrypt segments written before a key rotation until compaction rewrites
+// them with the current one.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring reads keys written as ID:HEX, one per line or separated by commas. The
+// first key is the current one. Keys must be 16, 24 or 32 bytes long.
+func ParseKeyring(text string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, hexKey, ok := strings.Cut(line, ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("expected ID:HEX-KEY, got %q", line)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		if k.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+		if k.current == "" {
+			k.current = id
+		}
+	}
+	if k.current == "" {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return k, nil
+}
+
+// ReadKeyring parses the keys from a file, or from the environment variable env if
+// path is empty. It returns nil if neither is set.
+func ReadKeyring(path, env string) (*Keyring, error) {
+	text := os.Getenv(env)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return nil, nil
+	}
+	return ParseKeyring(text)
+}
+
+// WithEncryption encrypts the values of new segments with the current key of keys.
+func WithEncryption(keys *Keyring) Option {
+	return func(o *options) { o.keys = keys }
+}
+
+// Current returns the ID of the key new segments are encrypted with, or an empty
+// string if k is nil.
+func (k *Keyring) Current() string {
+	if k == nil {
+		return ""
+	}
+	return k.current
+}
+
+// aead returns the cipher of the key id; the empty id stands for plain text.
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	if id == "" {
+		return nil, nil
+	}
+	if k != nil {
+		if aead, ok := k.keys[id]; ok {
+			return aead, nil
+		}
+	}
+	return nil, fmt.Errorf("segment is encrypted with unknown key %q", id)
+}
+
+func sealValue(aead cipher.AEAD, value, additional []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, value, additional)
+}
+
+func openValue(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrChecksum
+	}
+	n := aead.NonceSize()
+	value, err := aead.Open(nil, sealed[:n], sealed[n:], additional)
+	if err != nil {
+		return nil, ErrChecksum
+	}
+	return value, nil
+}
@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, text string) *Keyring {
+	t.Helper()
+	keys, err := ParseKeyring(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestParseKeyring(t *testing.T) {
+	keys := testKeyring(t, "# rotated monthly\nnew:"+strings.Repeat("01", 32)+"\nold:"+strings.Repeat("02", 16))
+	if keys.Current() != "new" {
+		t.Errorf("Expected the first key to be current, got %s", keys.Current())
+	}
+	if _, err := keys.aead("old"); err != nil {
+		t.Error(err)
+	}
+	for _, text := range []string{"", "nokey", "k:zz", "k:0102"} {
+		if _, err := ParseKeyring(text); err == nil {
+			t.Errorf("Expected an error for %q", text)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := "k1:" + strings.Repeat("11", 32)
+	db, err := NewDb(dir, 300, WithEncryption(testKeyring(t, first)), WithCompression(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put("customer"+string(rune('a'+i)), strings.Repeat("secret", i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("customera"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	paths, _ := filepath.Glob(filepath.Join(dir, outFileName+"*"))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _, err := readSegmentHeader(bytes.NewReader(data))
+		if err != nil || header.keyID != "k1" || bytes.Contains(data, []byte("secret")) {
+			t.Errorf("Expected %s to be encrypted with k1", path)
+		}
+	}
+
+	if _, err := NewDb(dir, 300); err == nil {
+		t.Error("Expected opening encrypted segments without the key to fail")
+	}
+	// A wrong key under the right ID must not be mistaken for damage and cut anything off.
+	sizes := make(map[string]int64)
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err == nil {
+			sizes[path] = stat.Size()
+		}
+	}
+	if _, err := NewDb(dir, 300, WithEncryption(testKeyring(t, "k1:"+strings.Repeat("33", 32)))); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey for a wrong key, got %v", err)
+	}
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err != nil || stat.Size() != sizes[path] {
+			t.Errorf("Expected %s to be left as it was", path)
+		}
+	}
+
+	// After a rotation old segments are read with the old key and rewritten by compaction.
+	db, err = NewDb(dir, 300, WithEncryption(testKeyring(t, "k2:"+strings.Repeat("22", 32)+","+first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("customert"); err != nil || value != strings.Repeat("secret", 20) {
+		t.Errorf("Unexpected value %q, %v", value, err)
+	}
+	if err := db.Put("customerb", "rotated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range db.Segments() {
+		if s.KeyID != "k2" {
+			t.Errorf("Expected segment %d to be encrypted with k2, got %q", s.ID, s.KeyID)
+		}
+	}
+	if _, err := db.Get("customera"); err != ErrNotFound {
+		t.Errorf("Expected the deleted key to stay deleted, got %v", err)
+	}
+	if value, err := db.Get("customerb"); err != nil || value != "rotated" {
+		t.Errorf("Unexpected value %q, %v", value, err)
+	}
+
+	// The tag detects changed values like the SHA-1 checksum does.
+	s := db.segments[0]
+	pos, _ := s.lookup("customerc")
+	f, err := os.OpenFile(s.outPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff}, pos.offset+pos.size-1)
+	f.Close()
+	db.cache.purge(s)
+	if _, err := db.Get("customerc"); err != ErrChecksum {
+		t.Errorf("Expected ErrChecksum for a changed record, got %v", err)
+	}
+}
@@ -2,11 +2,17 @@ package datastore
 
 import (
 	"bufio"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -14,12 +20,44 @@ const bufSize = 8192
 
 const outFileName = "current-data"
 
+// mergeSuffix marks a merged segment that is still being written.
+const mergeSuffix = ".merge"
+
 var ErrNotFound = fmt.Errorf("record does not exist")
 
-type hashInd map[string]int64
+// recordPos locates a record in its segment file.
+type recordPos struct {
+	offset  int64
+	size    int64
+	deleted bool
+	seq     uint64
+}
+
+type hashInd map[string]recordPos
+
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
 
 type FileSegment struct {
-	index   hashInd
+	id   int
+	size int64
+	// live counts the bytes of the records that hold the newest value of their key.
+	// The rest of the segment is dead and can be reclaimed by compaction.
+	live  int64
+	index hashInd
+	// history holds older records of keys of index, oldest first, while a snapshot
+	// may still read them.
+	history map[string][]recordPos
+	// start is the offset of the first record, after the segment header.
+	start   int64
+	version uint16
+	keyID   string
+	aead    cipher.AEAD
+	// Sealed segments get a Bloom filter, and may keep their index as a sortedIndex.
+	filter  *bloomFilter
+	sorted  *sortedIndex
 	outPath string
 	mutex   sync.RWMutex
 }
@@ -32,9 +70,54 @@ type Db struct {
 	totalNumber int
 	segments    []*FileSegment
 	indexMutex  sync.RWMutex
+	cache       *recordCache
+	// compactIndex keeps the indexes of sealed segments as sortedIndex.
+	compactIndex bool
+	// codec is what new records are written with; new segments use the current key.
+	codec  recordCodec
+	keys   *Keyring
+	limits sizeLimits
+	// seq is the sequence number of the last write; snapshots counts the live
+	// snapshots by the sequence number they read at.
+	seq       uint64
+	snapshots map[uint64]int
+	watchers  watchers
+
+	policy         CompactionPolicy
+	compactionRate int64
+	compactMutex   sync.Mutex
+	compactions    sync.WaitGroup
+}
+
+type options struct {
+	cacheSize      int64
+	compactIndex   bool
+	compression    int
+	keys           *Keyring
+	memtableSize   int64
+	policy         CompactionPolicy
+	compactionRate int64
+	maxKeySize     int
+	maxValueSize   int
+}
+
+type Option func(*options)
+
+// WithCacheSize enables a cache of recently read records bounded by about size bytes.
+func WithCacheSize(size int64) Option {
+	return func(o *options) { o.cacheSize = size }
+}
+
+// WithCompression stores values of at least threshold bytes compressed with flate when
+// that saves space. Records are read back the same way with or without this option.
+func WithCompression(threshold int) Option {
+	return func(o *options) { o.compression = threshold }
 }
 
 func (s *FileSegment) getValue(position int64) (string, error) {
+	if s.version > segmentVersion {
+		return "", fmt.Errorf("%s: %w %d", s.outPath, ErrUnsupportedVersion, s.version)
+	}
 	file, err := os.Open(s.outPath)
 	if err != nil {
 		return "", err
@@ -47,7 +130,7 @@ func (s *FileSegment) getValue(position int64) (string, error) {
 		return "", err
 	}
 
-	value, err := readValue(newReader)
+	value, err := readValue(newReader, s.aead)
 	if err != nil {
 		return "", err
 	}
@@ -55,23 +138,42 @@ func (s *FileSegment) getValue(position int64) (string, error) {
 	return value, nil
 }
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
-	db := &Db{
-		segments:    make([]*FileSegment, 0),
-		dir:         dir,
-		segmentSize: segmentSize,
+func NewDb(dir string, segmentSize int64, opts ...Option) (*Db, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	err := db.newSegment()
+	if o.policy == nil {
+		o.policy = SizeTiered{MinSegments: 4, Ratio: 2}
+	}
+	limits, err := newSizeLimits(o)
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.recover()
-	if err != nil && err != io.EOF {
+	db := &Db{
+		segments:       make([]*FileSegment, 0),
+		dir:            dir,
+		segmentSize:    segmentSize,
+		cache:          newRecordCache(o.cacheSize),
+		compactIndex:   o.compactIndex,
+		keys:           o.keys,
+		limits:         limits,
+		snapshots:      make(map[uint64]int),
+		policy:         o.policy,
+		compactionRate: o.compactionRate,
+	}
+
+	aead, err := o.keys.aead(o.keys.Current())
+	if err != nil {
 		return nil, err
 	}
+	db.codec = recordCodec{compression: o.compression, keyID: o.keys.Current(), aead: aead}
 
+	if err := db.recover(); err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
@@ -86,130 +188,227 @@ func (db *Db) newSegment() error {
 		return err
 	}
 
+	header := newSegmentHeader(db.codec.keyID).encode()
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
 	newFileSegment := &FileSegment{
+		id:      db.totalNumber - 1,
 		outPath: outPath,
 		index:   make(hashInd),
+		start:   int64(len(header)),
+		size:    int64(len(header)),
+		version: segmentVersion,
+		keyID:   db.codec.keyID,
+		aead:    db.codec.aead,
 	}
 
 	db.out.Close()
 	db.out = f
-	db.outOffset = 0
-
-	db.segments = append(db.segments, newFileSegment)
+	db.outOffset = newFileSegment.start
 
-	if len(db.segments) >= 3 {
-		db.consolidateSegments()
+	if len(db.segments) > 0 {
+		db.segments[len(db.segments)-1].seal(db.compactIndex)
 	}
+	db.segments = append(db.segments, newFileSegment)
+	db.maybeCompact()
 	return nil
 }
 
-func (db *Db) consolidateSegments() {
-	go func() {
-		outFile := fmt.Sprintf("%s%d", outFileName, db.totalNumber)
-		outPath := filepath.Join(db.dir, outFile)
-		db.totalNumber++
-
-		newSegment := &FileSegment{
-			outPath: outPath,
-			index:   make(hashInd),
-		}
-		var offset int64
+// segmentFiles returns the paths and numbers of the segment files in dir in the order
+// of their numbers. Leftovers of an interrupted merge are removed.
+func segmentFiles(dir string) ([]string, []int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, outFileName+"*"))
+	if err != nil {
+		return nil, nil, err
+	}
 
-		f, err := os.OpenFile(outPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	numbers := make(map[int]string)
+	var order []int
+	for _, path := range files {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), outFileName))
 		if err != nil {
-			return
+			if strings.HasSuffix(path, mergeSuffix) {
+				os.Remove(path)
+			}
+			continue
 		}
-		defer f.Close()
-
-		lastIndex := len(db.segments) - 2
-
-		for i := 0; i <= lastIndex; i++ {
-
-			s := db.segments[i]
-
-			for key, index := range s.index {
-				if i < lastIndex {
-					cloneFlag := false
-					for _, segment := range db.segments[i+1 : lastIndex+1] {
-						if _, ok := segment.index[key]; ok {
-							cloneFlag = true
-							break
-						}
-					}
-					if cloneFlag {
-						continue
-					}
-				}
+		numbers[n] = path
+		order = append(order, n)
+	}
+	sort.Ints(order)
 
-				value, _ := s.getValue(index)
+	paths := make([]string, len(order))
+	for i, n := range order {
+		paths[i] = numbers[n]
+	}
+	return paths, order, nil
+}
 
-				entry := entry{
-					key:   key,
-					value: value,
-				}
+// recover loads every segment in dir in the order of their numbers and continues
+// writing to the last one.
+func (db *Db) recover() error {
+	paths, order, err := segmentFiles(db.dir)
+	if err != nil {
+		return err
+	}
 
-				n, err := f.Write(entry.Encode())
+	if len(order) == 0 {
+		return db.newSegment()
+	}
 
-				if err == nil {
-					newSegment.index[key] = offset
-					offset += int64(n)
-				}
+	for i, n := range order {
+		segment := &FileSegment{
+			id:      n,
+			outPath: paths[i],
+			index:   make(hashInd),
+		}
+		if err := segment.load(db.keys, i == len(order)-1); err != nil {
+			return err
+		}
+		db.segments = append(db.segments, segment)
+	}
+	db.totalNumber = order[len(order)-1] + 1
+
+	// load counted the newest records of each segment as live; those that a newer
+	// segment overrides are dead.
+	seen := make(map[string]bool)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		s := db.segments[i]
+		for key, pos := range s.index {
+			if seen[key] && !pos.deleted {
+				s.live -= pos.size
+			}
+			seen[key] = true
+			if pos.seq > db.seq {
+				db.seq = pos.seq
 			}
 		}
+	}
+	for _, s := range db.segments[:len(db.segments)-1] {
+		s.seal(db.compactIndex)
+	}
 
-		db.segments = []*FileSegment{newSegment, db.segments[len(db.segments)-1]}
-	}()
+	// Segments in an older format are rewritten by compaction.
+	outdated := false
+	for _, s := range db.segments {
+		outdated = outdated || s.version < segmentVersion
+	}
+	active := db.segments[len(db.segments)-1]
+	if active.keyID != db.codec.keyID || active.version != segmentVersion {
+		// Every segment is written in one format with a single key, or none.
+		return db.newSegment()
+	}
+	if outdated {
+		db.maybeCompact()
+	}
+	f, err := os.OpenFile(active.outPath, os.O_APPEND|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	db.out = f
+	db.outOffset = active.size
+	return nil
 }
 
-func (db *Db) recover() error {
-	var err error
-	var buf [bufSize]byte
-
-	in := bufio.NewReaderSize(db.out, bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
-		} else if err != nil {
-			return err
+// load builds the index of the segment file, decrypting it with a key of keys. A torn
+// or corrupted tail of the active segment, the one writes go to, is what a crash leaves
+// and is cut off. Sealed segments were complete when they were sealed, so damage there
+// is an error, as is a record that fails authentication: cutting it off would lose data
+// that dbtool repair can keep.
+func (s *FileSegment) load(keys *Keyring, active bool) error {
+	f, err := os.OpenFile(s.outPath, os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := stat.Size()
+
+	header, start, err := readSegmentHeader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.outPath, err)
+	}
+	s.start, s.version, s.keyID = start, header.version, header.keyID
+	if s.aead, err = keys.aead(s.keyID); err != nil {
+		return fmt.Errorf("%s: %w", s.outPath, err)
+	}
+	s.size = s.start
+	if _, err := f.Seek(s.start, io.SeekStart); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(f, bufSize)
+	for s.size < fileSize {
+		header, err := in.Peek(4)
+		if err != nil {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(header))
+		if size < 4 || s.size+size > fileSize {
+			break
 		}
-		size := binary.LittleEndian.Uint32(header)
 
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
+		data := make([]byte, size)
+		if _, err := io.ReadFull(in, data); err != nil {
+			break
 		}
 
-		n, err = in.Read(data)
+		var e entry
+		if err := e.decode(data, s.aead); err != nil {
+			if err == ErrChecksum && s.aead != nil {
+				if s.size == s.start {
+					// Not even the first record opens, so the key must be wrong.
+					return fmt.Errorf("%s: %w %q", s.outPath, ErrWrongKey, s.keyID)
+				}
+				return s.damaged(s.size, err)
+			}
+			break
+		}
+		if prev, ok := s.index[e.key]; ok && !prev.deleted {
+			s.live -= prev.size
+		}
+		if !e.deleted {
+			s.live += size
+		}
+		s.index[e.key] = recordPos{offset: s.size, size: size, deleted: e.deleted, seq: e.seq}
+		s.size += size
+	}
 
-		if err == nil {
-			var e entry
-			e.Decode(data)
-			db.segments[len(db.segments)-1].index[e.key] = db.outOffset
-			db.outOffset += int64(n)
-			db.indexMutex.Lock()
-			db.indexMutex.Unlock()
+	if s.size < fileSize {
+		if !active {
+			return s.damaged(s.size, ErrTornTail)
 		}
+		log.Printf("Dropping %d corrupted bytes at the tail of %s", fileSize-s.size, s.outPath)
+		return f.Truncate(s.size)
 	}
+	return nil
+}
 
-	return err
+func (s *FileSegment) damaged(offset int64, err error) error {
+	return fmt.Errorf("%s: record at offset %d: %w; run dbtool repair to drop the damaged records", s.outPath, offset, err)
 }
 
 func (db *Db) Get(key string) (string, error) {
 	db.indexMutex.RLock()
 	defer db.indexMutex.RUnlock()
+	return db.get(key)
+}
 
+func (db *Db) get(key string) (string, error) {
+	return db.getAt(key, math.MaxUint64)
+}
+
+// getAt reads the newest value of key written up to the sequence number seq.
+func (db *Db) getAt(key string, seq uint64) (string, error) {
 	var (
 		segment *FileSegment
-		pos     int64
+		pos     recordPos
 		ok      bool
 	)
 
@@ -217,7 +416,7 @@ func (db *Db) Get(key string) (string, error) {
 		segment = db.segments[len(db.segments)-i-1]
 		segment.mutex.RLock()
 
-		pos, ok = segment.index[key]
+		pos, ok = segment.lookupAt(key, seq)
 
 		segment.mutex.RUnlock()
 		if ok {
@@ -225,28 +424,85 @@ func (db *Db) Get(key string) (string, error) {
 		}
 	}
 
-	if !ok {
+	if !ok || pos.deleted {
 		return "", ErrNotFound
 	}
 
-	value, err := segment.getValue(pos)
-	if err != nil {
-		return "", err
+	return db.readValue(segment, pos.offset)
+}
+
+func (db *Db) readValue(segment *FileSegment, pos int64) (string, error) {
+	if value, deleted, ok := db.cache.get(segment, pos); ok {
+		if deleted {
+			return "", ErrNotFound
+		}
+		return value, nil
 	}
 
-	return value, nil
+	value, err := segment.getValue(pos)
+	if err == ErrNotFound {
+		db.cache.add(segment, pos, "", true)
+	} else if err == nil {
+		db.cache.add(segment, pos, value, false)
+	}
+	return value, err
 }
 
 func (db *Db) Put(key, value string) error {
-	entry := entry{
+	db.indexMutex.Lock()
+	defer db.indexMutex.Unlock()
+
+	return db.write(entry{
 		key:   key,
 		value: value,
+	})
+}
+
+// Write applies all operations of the batch with a single append to the log,
+// so readers see either none or all of them.
+func (db *Db) Write(b *WriteBatch) error {
+	if len(b.entries) == 0 {
+		return nil
 	}
 
 	db.indexMutex.Lock()
 	defer db.indexMutex.Unlock()
 
-	encodedEntry := entry.Encode()
+	return db.write(b.entries...)
+}
+
+// Delete writes a tombstone for the key. It returns ErrNotFound if the key has no value.
+func (db *Db) Delete(key string) error {
+	db.indexMutex.Lock()
+	defer db.indexMutex.Unlock()
+
+	if _, err := db.get(key); err != nil {
+		return err
+	}
+	return db.write(entry{
+		key:     key,
+		deleted: true,
+	})
+}
+
+// write appends the entries with the next sequence number, so that snapshots see all
+// of them or none.
+func (db *Db) write(entries ...entry) error {
+	if err := db.limits.check(entries); err != nil {
+		return err
+	}
+	seq := db.seq + 1
+	var encodedEntry []byte
+	offsets := make([]int64, len(entries))
+	sizes := make([]int64, len(entries))
+	for i := range entries {
+		e := entries[i]
+		e.seq = seq
+		data := e.encode(db.codec)
+		offsets[i] = int64(len(encodedEntry))
+		sizes[i] = int64(len(data))
+		encodedEntry = append(encodedEntry, data...)
+	}
 	size := int64(len(encodedEntry))
 
 	stat, err := db.out.Stat()
@@ -265,13 +521,92 @@ func (db *Db) Put(key, value string) error {
 	if err != nil {
 		return err
 	}
-
-	db.segments[len(db.segments)-1].index[entry.key] = db.outOffset
+	db.seq = seq
+
+	active := db.segments[len(db.segments)-1]
+	for i, entry := range entries {
+		db.supersede(entry.key)
+		active.index[entry.key] = recordPos{offset: db.outOffset + offsets[i], size: sizes[i], deleted: entry.deleted, seq: seq}
+		if !entry.deleted {
+			active.live += sizes[i]
+		}
+	}
 	db.segments[len(db.segments)-1].mutex.Lock()
 	db.segments[len(db.segments)-1].mutex.Unlock()
 	db.outOffset += int64(n)
+	db.segments[len(db.segments)-1].size = db.outOffset
 
+	db.watchers.notify(entries, seq)
 	return nil
 }
 
-func (db *Db) Close() { db.out.Close() }
+// supersede marks the newest record of key as dead before a newer one is written. If it
+// is in the active segment and a snapshot may read it, it is kept in the history.
+func (db *Db) supersede(key string) {
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		s := db.segments[i]
+		if pos, ok := s.lookup(key); ok {
+			if !pos.deleted {
+				s.live -= pos.size
+			}
+			if i == len(db.segments)-1 && db.pinned(pos.seq) {
+				if s.history == nil {
+					s.history = make(map[string][]recordPos)
+				}
+				s.history[key] = append(s.history[key], pos)
+			}
+			return
+		}
+	}
+}
+
+// Scan returns the live records whose keys start with prefix, sorted by key.
+func (db *Db) Scan(prefix string) ([]KeyValue, error) {
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+	return db.scanAt(prefix, math.MaxUint64)
+}
+
+func (db *Db) scanAt(prefix string, seq uint64) ([]KeyValue, error) {
+	seen := make(map[string]bool)
+	var (
+		res []KeyValue
+		err error
+	)
+	for i := len(db.segments) - 1; i >= 0 && err == nil; i-- {
+		segment := db.segments[i]
+		segment.mutex.RLock()
+		segment.forEach(func(key string, pos recordPos) {
+			if err != nil || seen[key] || !strings.HasPrefix(key, prefix) {
+				return
+			}
+			// Keys written only after seq in this segment may have older values before it.
+			var ok bool
+			if pos, ok = segment.lookupAt(key, seq); !ok {
+				return
+			}
+			seen[key] = true
+			if pos.deleted {
+				return
+			}
+
+			var value string
+			if value, err = segment.getValue(pos.offset); err == nil {
+				res = append(res, KeyValue{Key: key, Value: value})
+			}
+		})
+		segment.mutex.RUnlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res, nil
+}
+
+func (db *Db) Close() {
+	db.watchers.closeAll()
+	db.compactions.Wait()
+	db.out.Close()
+}
@@ -1,9 +1,13 @@
 package datastore
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -87,7 +91,9 @@ func TestPutAndGet(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if size1*2 != outInfo.Size() {
+		// The records are written twice after the segment header.
+		start := db.segments[0].start
+		if (size1-start)*2 != outInfo.Size()-start {
 			t.Errorf("Unexpected size (%d != %d)", size1, outInfo.Size())
 		}
 	})
@@ -133,13 +139,29 @@ func TestPutAndGet(t *testing.T) {
 				t.Errorf("Data mismatch: got %v, want %v", retrievedValue, d.value)
 			}
 
-			filePath := filepath.Join(dir, outFileName+"0")
-			if err := ioutil.WriteFile(filePath, []byte("corrupted data"), 0644); err != nil {
-				t.Fatal("Failed to corrupt data file")
+			// A reopened db reads every segment, so all of them are corrupted. Only the
+			// tail of the active one is cut off; sealed ones have to be repaired.
+			db.Close()
+			files, err := filepath.Glob(filepath.Join(dir, outFileName+"*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, filePath := range files {
+				if err := ioutil.WriteFile(filePath, []byte("corrupted data"), 0644); err != nil {
+					t.Fatal("Failed to corrupt data file")
+				}
 			}
 
-			db.out.Close()
 			db, err = NewDb(dir, 333)
+			if len(files) > 1 {
+				if err == nil || !strings.Contains(err.Error(), "dbtool repair") {
+					t.Fatalf("Expected an error for corrupted sealed segments, got %v", err)
+				}
+				if _, err := Repair(dir); err != nil {
+					t.Fatal(err)
+				}
+				db, err = NewDb(dir, 333)
+			}
 			if err != nil {
 				t.Fatal("Failed to reopen the database")
 			}
@@ -151,3 +173,386 @@ func TestPutAndGet(t *testing.T) {
 		}
 	})
 }
+
+func TestDelete(t *testing.T) {
+	forEngines(t, func(t *testing.T, open func(size int64, opts ...Option) Store) {
+		s := open(100)
+		defer s.Close()
+
+		if err := s.Delete("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound deleting a missing key, got %v", err)
+		}
+
+		if err := s.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		// Push the deletion into a newer segment or table than the value it shadows.
+		for i := 0; i < 4; i++ {
+			if err := s.Put(fmt.Sprintf("filler%d", i), "filler-value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Delete("key1"); err != nil {
+			t.Fatal(err)
+		}
+		if db, ok := s.(*Db); ok && len(db.segments) < 2 {
+			t.Fatalf("Expected the tombstone in a new segment, got %d segments", len(db.segments))
+		}
+
+		if _, err := s.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+		if err := s.Delete("key1"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+		}
+
+		if err := s.Put("key1", "value2"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := s.Get("key1"); err != nil || value != "value2" {
+			t.Errorf("Unexpected value after re-put: %q, %v", value, err)
+		}
+	})
+}
+
+func TestScanAndWriteBatch(t *testing.T) {
+	forEngines(t, func(t *testing.T, open func(size int64, opts ...Option) Store) {
+		s := open(150)
+		defer s.Close()
+
+		for _, kv := range []KeyValue{{"user/2", "old"}, {"user/1", "a"}, {"order/1", "o"}, {"user/3", "c"}, {"users", "x"}} {
+			if err := s.Put(kv.Key, kv.Value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		b := new(WriteBatch)
+		b.Put("user/2", "b")
+		b.Delete("user/3")
+		b.Delete("user/missing")
+		if err := s.Write(b); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := s.Scan("user/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []KeyValue{{"user/1", "a"}, {"user/2", "b"}}
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("Unexpected scan result %v", res)
+		}
+
+		all, err := s.Scan("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 4 || all[0].Key != "order/1" || all[3].Key != "users" {
+			t.Errorf("Unexpected full scan result %v", all)
+		}
+	})
+}
+
+func TestCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 200, WithCacheSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i%7)
+		value := fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+		// Read through the cache, so that compaction has entries to purge.
+		if _, err := db.Get(key); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			db.compactions.Wait()
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	delete(expected, "key0")
+	db.compactions.Wait()
+
+	for key, value := range expected {
+		if res, err := db.Get(key); err != nil || res != value {
+			t.Errorf("Unexpected value of %s after compaction: %q, %v", key, res, err)
+		}
+	}
+	if _, err := db.Get("key0"); err != ErrNotFound {
+		t.Errorf("Expected the deleted key to stay deleted, got %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, outFileName+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(db.segments) {
+		t.Errorf("Expected merged segment files to be removed, got %d files for %d segments", len(files), len(db.segments))
+	}
+
+	live := make(map[*FileSegment]bool)
+	for _, s := range db.segments {
+		live[s] = true
+	}
+	for key := range db.cache.items {
+		if !live[key.segment] {
+			t.Fatal("Cache holds records of a segment removed by compaction")
+		}
+	}
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	paths, err := SegmentFiles(dir)
+	if err != nil || len(paths) < 2 {
+		t.Fatalf("Expected several segments, got %v, %v", paths, err)
+	}
+	tear := func(path string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		torn := (&entry{key: "torn", value: "value"}).Encode()
+		f.Write(torn[:len(torn)-5])
+		f.Close()
+	}
+
+	// A crash leaves a torn tail in the active segment, which is cut off.
+	tear(paths[len(paths)-1])
+	db, err = NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Unexpected value of key%d after recovery: %q, %v", i, value, err)
+		}
+	}
+	db.Close()
+
+	// A sealed segment is never truncated.
+	tear(paths[0])
+	if _, err := NewDb(dir, 100); err == nil || !strings.Contains(err.Error(), paths[0]) || !strings.Contains(err.Error(), "dbtool repair") {
+		t.Errorf("Expected an error naming the damaged segment, got %v", err)
+	}
+}
+
+func TestRecordCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const capacity = 4 * (cacheEntryOverhead + 8)
+	db, err := NewDb(dir, 1<<20, WithCacheSize(capacity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := db.Put(key, "value-0"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.cache.size > capacity || db.cache.lru.Len() != 4 {
+		t.Errorf("Cache is not bounded: %d bytes in %d records", db.cache.size, db.cache.lru.Len())
+	}
+
+	if err := db.Put("key9", "value-1"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key9"); err != nil || value != "value-1" {
+		t.Errorf("Expected the new value after Put, got %q, %v", value, err)
+	}
+	if err := db.Delete("key9"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key9"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after Delete, got %v", err)
+	}
+}
+
+func benchmarkGetHot(b *testing.B, opts ...Option) {
+	dir, err := ioutil.TempDir("", "bench-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	value := strings.Repeat("v", 512)
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i%10)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetHot(b *testing.B) {
+	b.Run("no-cache", func(b *testing.B) { benchmarkGetHot(b) })
+	b.Run("cache", func(b *testing.B) { benchmarkGetHot(b, WithCacheSize(1<<20)) })
+}
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	value := func(i int) string {
+		return fmt.Sprintf(`{"id":%d,"items":[%s]}`, i, strings.Repeat(`{"name":"item","count":1},`, 10))
+	}
+
+	// Records written before compression was enabled stay readable.
+	db, err := NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("old", value(0)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, 2000, WithCompression(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, size := totalLive(db); size >= int64(30*len(value(0))) {
+		t.Errorf("Expected compressed segments, got %d bytes", size)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get("old"); err != nil || v != value(0) {
+		t.Errorf("Unexpected old value %q, %v", v, err)
+	}
+	for i := 20; i < 30; i++ {
+		if v, err := db.Get(fmt.Sprintf("key%d", i%10)); err != nil || v != value(i) {
+			t.Errorf("Unexpected value of key%d: %q, %v", i%10, v, err)
+		}
+	}
+	res, err := db.Scan("key")
+	if err != nil || len(res) != 10 || res[0].Value != value(20) {
+		t.Errorf("Unexpected scan result %v, %v", res, err)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	forEngines(t, func(t *testing.T, open func(size int64, opts ...Option) Store) {
+		s := open(200)
+		defer s.Close()
+
+		var sizeErr *SizeError
+		err := s.Put(strings.Repeat("k", DefaultMaxKeySize+1), "value")
+		if !errors.As(err, &sizeErr) || sizeErr.Field != "key" || sizeErr.Limit != DefaultMaxKeySize {
+			t.Errorf("Expected a SizeError for the key, got %v", err)
+		}
+
+		b := new(WriteBatch)
+		b.Put("small", "value")
+		b.Put("large", strings.Repeat("v", DefaultMaxValueSize+1))
+		if err := s.Write(b); !errors.Is(err, ErrTooLarge) || !errors.As(err, &sizeErr) || sizeErr.Field != "value" {
+			t.Errorf("Expected a SizeError for the value, got %v", err)
+		}
+		if _, err := s.Get("small"); err != ErrNotFound {
+			t.Errorf("Expected nothing of the batch to be written, got %v", err)
+		}
+
+		if err := s.Put("large", strings.Repeat("v", DefaultMaxValueSize)); err != nil {
+			t.Errorf("Failed to write a value at the limit: %v", err)
+		}
+	})
+
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewDb(dir, 200, WithSizeLimits(0, 1<<30)); err == nil {
+		t.Error("Expected a value limit beyond the record format to be refused")
+	}
+
+	db, err := NewDb(dir, 200, WithSizeLimits(4, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "123456789"); err == nil || err.Error() != "value of 9 bytes exceeds the limit of 8 bytes" {
+		t.Errorf("Unexpected error for a long value: %v", err)
+	}
+	tx := db.Begin()
+	tx.Put("key12", "value")
+	if err := tx.Commit(); err == nil || err.Error() != "key of 5 bytes exceeds the limit of 4 bytes" {
+		t.Errorf("Unexpected error for a long key: %v", err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "12345678" {
+		t.Errorf("Got %q, %v after rejected writes", value, err)
+	}
+}
@@ -2,48 +2,210 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/cipher"
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"sync"
 )
 
+// The top bits of the value length field carry record flags. Records written before
+// flags were introduced never set them, because their values are far below the limit.
+const (
+	flagDeleted uint32 = 1 << 31
+	// flagCompressed marks a value stored compressed with flate.
+	flagCompressed uint32 = 1 << 30
+	// flagEncrypted marks a value sealed with AES-GCM: a nonce followed by the cipher
+	// text and the tag, which authenticates the record instead of the SHA-1 checksum.
+	flagEncrypted uint32 = 1 << 29
+	// flagSequenced marks a record that carries the sequence number of its write in the
+	// 8 bytes between the value length and the value.
+	flagSequenced uint32 = 1 << 28
+
+	knownFlags   = flagDeleted | flagCompressed | flagEncrypted | flagSequenced
+	valueLenMask = 1<<28 - 1
+)
+
+var ErrChecksum = fmt.Errorf("SHA-1 checksum does not match")
+
+// recordCodec holds the settings new records are written with: the compression
+// threshold, zero for none, and the key of an encrypted segment.
+type recordCodec struct {
+	compression int
+	keyID       string
+	aead        cipher.AEAD
+}
+
 type entry struct {
 	key, value string
+	deleted    bool
+	// seq orders the writes of the db; records of other stores and of old segments have 0.
+	seq uint64
+}
+
+func (e *entry) flags() uint32 {
+	var flags uint32
+	if e.deleted {
+		flags |= flagDeleted
+	}
+	if e.seq != 0 {
+		flags |= flagSequenced
+	}
+	return flags
 }
 
 func (e *entry) Encode() []byte {
+	return e.encode(recordCodec{})
+}
+
+// encode compresses values of at least the threshold of c if that makes them smaller.
+// The checksum covers the stored bytes. With a cipher, the value is sealed with the
+// record header and key as additional data, and no checksum is written.
+func (e *entry) encode(c recordCodec) []byte {
+	value, flags := []byte(e.value), e.flags()
+	if c.compression > 0 && len(value) >= c.compression {
+		if compressed := compress(value); len(compressed) < len(value) {
+			value, flags = compressed, flags|flagCompressed
+		}
+	}
+
 	kl := len(e.key)
-	vl := len(e.value)
-	hash := sha1.Sum([]byte(e.value))
-	size := kl + vl + 12 + len(hash)
+	vl := len(value)
+	// start is the offset of the value.
+	start := kl + 12
+	if e.seq != 0 {
+		start += 8
+	}
+	var hash []byte
+	if c.aead != nil {
+		flags |= flagEncrypted
+		vl += c.aead.NonceSize() + c.aead.Overhead()
+	} else {
+		sum := sha1.Sum(value)
+		hash = sum[:]
+	}
+	size := start + vl + len(hash)
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
-	copy(res[kl+vl+12:], hash[:])
+	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl)|flags)
+	if e.seq != 0 {
+		binary.LittleEndian.PutUint64(res[kl+12:], e.seq)
+	}
+	if c.aead != nil {
+		copy(res[start:], sealValue(c.aead, value, res[4:start]))
+	} else {
+		copy(res[start:], value)
+		copy(res[start+vl:], hash)
+	}
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
+// Flate writers allocate hundreds of kilobytes, so they are reused.
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func decompress(data []byte) (string, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	res, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("can't decompress value: %w", err)
+	}
+	return string(res), nil
+}
+
+func (e *entry) Decode(input []byte) error {
+	return e.decode(input, nil)
+}
+
+// decode opens encrypted values with aead. Without it, an encrypted record only gets
+// its key and flags decoded, and ErrNoKey is returned.
+func (e *entry) decode(input []byte, aead cipher.AEAD) error {
+	if len(input) < 12+sha1.Size {
+		return fmt.Errorf("entry is too short (%d bytes)", len(input))
+	}
 	kl := binary.LittleEndian.Uint32(input[4:])
+	if uint64(kl)+12+sha1.Size > uint64(len(input)) {
+		return fmt.Errorf("key length %d is out of bounds", kl)
+	}
 	keyBuf := make([]byte, kl)
 	copy(keyBuf, input[8:kl+8])
 	e.key = string(keyBuf)
 
 	vl := binary.LittleEndian.Uint32(input[kl+8:])
-	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
-	e.value = string(valBuf)
+	flags := vl &^ valueLenMask
+	if flags&^knownFlags != 0 {
+		return fmt.Errorf("unsupported record flags %#x", flags)
+	}
+	e.deleted = flags&flagDeleted != 0
+	vl &= valueLenMask
+
+	start := uint64(kl) + 12
+	e.seq = 0
+	if flags&flagSequenced != 0 {
+		if start+8 > uint64(len(input)) {
+			return fmt.Errorf("sequence number is out of bounds")
+		}
+		e.seq = binary.LittleEndian.Uint64(input[start:])
+		start += 8
+	}
 
-	hashLen := sha1.Size
-	storedHash := input[len(input)-hashLen:]
-	calculatedHash := sha1.Sum(valBuf)
+	var valBuf []byte
+	if flags&flagEncrypted != 0 {
+		if start+uint64(vl) != uint64(len(input)) {
+			return fmt.Errorf("value length %d is out of bounds", vl)
+		}
+		if aead == nil {
+			return ErrNoKey
+		}
+		var err error
+		if valBuf, err = openValue(aead, input[start:], input[4:start]); err != nil {
+			return err
+		}
+		e.value = string(valBuf)
+	} else {
+		if start+uint64(vl)+sha1.Size != uint64(len(input)) {
+			return fmt.Errorf("value length %d is out of bounds", vl)
+		}
+		valBuf = make([]byte, vl)
+		copy(valBuf, input[start:start+uint64(vl)])
+		e.value = string(valBuf)
 
-	if !equal(storedHash, calculatedHash[:]) {
-		fmt.Errorf("SHA-1 checksum does not match")
+		hashLen := sha1.Size
+		storedHash := input[len(input)-hashLen:]
+		calculatedHash := sha1.Sum(valBuf)
+
+		if !equal(storedHash, calculatedHash[:]) {
+			return ErrChecksum
+		}
 	}
+	if flags&flagCompressed != 0 {
+		value, err := decompress(valBuf)
+		if err != nil {
+			return err
+		}
+		e.value = value
+	}
+	return nil
 }
 
 func equal(a, b []byte) bool {
@@ -58,35 +220,51 @@ func equal(a, b []byte) bool {
 	return true
 }
 
-func readValue(in *bufio.Reader) (string, error) {
+// readValue reads the value of the record at the start of in. Encrypted values are
+// opened with aead, which also checks that the record is intact.
+func readValue(in *bufio.Reader, aead cipher.AEAD) (string, error) {
 	header, err := in.Peek(8)
 	if err != nil {
 		return "", err
 	}
 	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
+	// The length fields and the key are the additional data of an encrypted value.
+	prefix := make([]byte, keySize+12)
+	if _, err := io.ReadFull(in, prefix); err != nil {
 		return "", err
 	}
 
-	header, err = in.Peek(4)
-	if err != nil {
-		return "", err
+	valSize := binary.LittleEndian.Uint32(prefix[keySize+8:])
+	if valSize&flagDeleted != 0 {
+		return "", ErrNotFound
 	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
-	if err != nil {
-		return "", err
+	flags := valSize &^ valueLenMask
+	valSize &= valueLenMask
+	if flags&flagSequenced != 0 {
+		// The sequence number is part of the additional data of an encrypted value.
+		seq := make([]byte, 8)
+		if _, err := io.ReadFull(in, seq); err != nil {
+			return "", err
+		}
+		prefix = append(prefix, seq...)
 	}
 
 	data := make([]byte, valSize)
-	n, err := in.Read(data)
+	n, err := io.ReadFull(in, data)
 	if err != nil {
-		return "", err
-	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+		return "", fmt.Errorf("can't read value bytes (read %d, expected %d): %w", n, valSize, err)
 	}
 
+	if flags&flagEncrypted != 0 {
+		if aead == nil {
+			return "", ErrNoKey
+		}
+		if data, err = openValue(aead, data, prefix[4:]); err != nil {
+			return "", err
+		}
+	}
+	if flags&flagCompressed != 0 {
+		return decompress(data)
+	}
 	return string(data), nil
 }
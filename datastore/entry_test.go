@@ -3,11 +3,13 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"strings"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -18,9 +20,9 @@ func TestEntry_Encode(t *testing.T) {
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
-	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	v, err := readValue(bufio.NewReader(bytes.NewReader(data)), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -28,3 +30,43 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Got bat value [%s]", v)
 	}
 }
+
+func TestEntry_Tombstone(t *testing.T) {
+	e := entry{key: "key", deleted: true}
+	data := e.Encode()
+
+	var decoded entry
+	if err := decoded.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.key != "key" || !decoded.deleted {
+		t.Errorf("Unexpected decoded entry %+v", decoded)
+	}
+
+	if _, err := readValue(bufio.NewReader(bytes.NewReader(data)), nil); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a tombstone, got %v", err)
+	}
+}
+
+func TestEntry_Compression(t *testing.T) {
+	value := strings.Repeat(`{"name":"item","tags":["a","b"]},`, 20)
+	e := entry{key: "key", value: value}
+
+	data := e.encode(recordCodec{compression: 64})
+	if len(data) >= len(e.Encode()) {
+		t.Errorf("Expected a compressed record, got %d bytes for a %d byte value", len(data), len(value))
+	}
+	var decoded entry
+	if err := decoded.Decode(data); err != nil || decoded.value != value {
+		t.Errorf("Unexpected decoded entry %q, %v", decoded.value, err)
+	}
+	if v, err := readValue(bufio.NewReader(bytes.NewReader(data)), nil); err != nil || v != value {
+		t.Errorf("Unexpected value %q, %v", v, err)
+	}
+
+	for _, e := range []entry{{key: "short", value: "tiny"}, {key: "random", value: "x7#Qp!2mZ"}} {
+		if data := e.encode(recordCodec{compression: 5}); binary.LittleEndian.Uint32(data[8+len(e.key):])&flagCompressed != 0 {
+			t.Errorf("Expected %s to be stored uncompressed", e.key)
+		}
+	}
+}
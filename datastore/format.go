@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// segmentVersion is the format new segments are written in. Segments without a header,
+// written before it was introduced, are version 0 and are rewritten by compaction.
+const segmentVersion = 1
+
+// ErrUnsupportedVersion is returned for segments written by a newer version of the db.
+var ErrUnsupportedVersion = fmt.Errorf("unsupported segment format version")
+
+// A segment starts with segmentMagic, the format version, flags, the creation time in
+// nanoseconds and the ID of the key of an encrypted segment. Segments without a header
+// start with a record, whose size never has these bytes.
+var segmentMagic = []byte("L4SG")
+
+const (
+	segmentEncrypted uint16 = 1 << 0
+
+	knownSegmentFlags = segmentEncrypted
+	segmentHeaderSize = 4 + 2 + 2 + 8 + 1
+)
+
+type segmentHeader struct {
+	version uint16
+	flags   uint16
+	created time.Time
+	keyID   string
+}
+
+func newSegmentHeader(keyID string) segmentHeader {
+	h := segmentHeader{version: segmentVersion, created: time.Now(), keyID: keyID}
+	if keyID != "" {
+		h.flags |= segmentEncrypted
+	}
+	return h
+}
+
+func (h segmentHeader) encode() []byte {
+	res := append([]byte(nil), segmentMagic...)
+	res = binary.LittleEndian.AppendUint16(res, h.version)
+	res = binary.LittleEndian.AppendUint16(res, h.flags)
+	res = binary.LittleEndian.AppendUint64(res, uint64(h.created.UnixNano()))
+	res = append(res, byte(len(h.keyID)))
+	return append(res, h.keyID...)
+}
+
+// readSegmentHeader returns the header of the segment and the offset of its first
+// record. Segments of an unknown version are refused with ErrUnsupportedVersion.
+func readSegmentHeader(r io.ReaderAt) (segmentHeader, int64, error) {
+	var h segmentHeader
+	buf := make([]byte, segmentHeaderSize)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return h, 0, err
+	}
+
+	if n < len(segmentMagic) || string(buf[:len(segmentMagic)]) != string(segmentMagic) {
+		return h, 0, nil
+	}
+	if n < segmentHeaderSize {
+		return h, 0, fmt.Errorf("segment header is too short (%d bytes)", n)
+	}
+	h.version = binary.LittleEndian.Uint16(buf[4:])
+	if h.version > segmentVersion {
+		return h, 0, fmt.Errorf("%w %d, this build reads up to %d", ErrUnsupportedVersion, h.version, segmentVersion)
+	}
+	h.flags = binary.LittleEndian.Uint16(buf[6:])
+	if h.flags&^knownSegmentFlags != 0 {
+		return h, 0, fmt.Errorf("unsupported segment flags %#x", h.flags)
+	}
+	h.created = time.Unix(0, int64(binary.LittleEndian.Uint64(buf[8:])))
+
+	id := make([]byte, buf[16])
+	if _, err := r.ReadAt(id, segmentHeaderSize); err != nil {
+		return h, 0, fmt.Errorf("reading the segment header: %w", err)
+	}
+	h.keyID = string(id)
+	return h, int64(segmentHeaderSize + len(id)), nil
+}
+
+// SegmentFormat returns the format version of the segment file at path and the size of
+// its header.
+func SegmentFormat(path string) (version int, headerSize int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	h, start, err := readSegmentHeader(f)
+	return int(h.version), start, err
+}
@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Segments written before the header was introduced are plain runs of records.
+	for n := 0; n < 3; n++ {
+		var data []byte
+		for i := 0; i < 5; i++ {
+			e := entry{key: fmt.Sprintf("key%d", i), value: fmt.Sprintf("value%d-%d", n, i)}
+			data = append(data, e.Encode()...)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%s%d", outFileName, n)), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.compactions.Wait()
+
+	for _, s := range db.Segments() {
+		if s.Version != segmentVersion || s.Start == 0 {
+			t.Errorf("Expected segment %d to be migrated, got %+v", s.ID, s)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprintf("value2-%d", i) {
+			t.Errorf("Unexpected value %q, %v after the migration", value, err)
+		}
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header := newSegmentHeader("")
+	header.version = segmentVersion + 1
+	data := append(header.encode(), (&entry{key: "key", value: "value"}).Encode()...)
+	path := filepath.Join(dir, outFileName+"0")
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDb(dir, 1<<20); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+	if err := WalkSegment(path, func(RecordInfo) error { return nil }); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected WalkSegment to refuse the segment, got %v", err)
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() != int64(len(data)) {
+		t.Errorf("Expected the segment to be left alone, got %v, %v", stat, err)
+	}
+}
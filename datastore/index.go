@@ -0,0 +1,226 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// bloomFilter answers whether a key may be in a sealed segment. About 10 bits per key
+// with 7 hash functions give false positives for around 1% of absent keys.
+type bloomFilter struct {
+	bits []uint64
+	k    uint32
+}
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+func newBloomFilter(keys int) *bloomFilter {
+	words := (keys*bloomBitsPerKey + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloomFilter{bits: make([]uint64, words), k: bloomHashes}
+}
+
+// bloomHash is stable across processes, so that LSM tables can store their filters.
+// FNV alone spreads similar keys poorly, so its result is mixed as in MurmurHash3.
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// positions derives the k bit positions from the two halves of a single hash.
+func (f *bloomFilter) positions(h uint64, fn func(bit uint64) bool) {
+	h1, h2 := h&0xffffffff, h>>32
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.k); i++ {
+		if !fn((h1 + i*h2) % m) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(key string) {
+	f.addHash(bloomHash(key))
+}
+
+func (f *bloomFilter) addHash(h uint64) {
+	f.positions(h, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	res := true
+	f.positions(bloomHash(key), func(bit uint64) bool {
+		res = f.bits[bit/64]&(1<<(bit%64)) != 0
+		return res
+	})
+	return res
+}
+
+// indexBlockLen is the number of keys in a block of a sortedIndex. Lookups binary
+// search the fences and then decode at most one block.
+const indexBlockLen = 32
+
+// sortedIndex is a read-only index for a sealed segment that takes a fraction of the
+// memory of a hashInd. Keys are sorted and packed into blocks, each key sharing its
+// prefix with the previous one; only the first key of every block is kept as a string.
+// An entry of a block is encoded as uvarints: shared prefix length, suffix length, the
+// suffix, offset, size<<1 with the lowest bit set for a tombstone, and sequence number.
+type sortedIndex struct {
+	fences []string
+	blocks [][]byte
+}
+
+func newSortedIndex(index hashInd) *sortedIndex {
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	idx := &sortedIndex{}
+	var (
+		block []byte
+		prev  string
+	)
+	for i, key := range keys {
+		if i%indexBlockLen == 0 {
+			if block != nil {
+				idx.blocks = append(idx.blocks, block)
+			}
+			block = nil
+			prev = ""
+			idx.fences = append(idx.fences, key)
+		}
+
+		shared := 0
+		for shared < len(prev) && shared < len(key) && prev[shared] == key[shared] {
+			shared++
+		}
+		pos := index[key]
+		flagged := uint64(pos.size) << 1
+		if pos.deleted {
+			flagged |= 1
+		}
+		block = binary.AppendUvarint(block, uint64(shared))
+		block = binary.AppendUvarint(block, uint64(len(key)-shared))
+		block = append(block, key[shared:]...)
+		block = binary.AppendUvarint(block, uint64(pos.offset))
+		block = binary.AppendUvarint(block, flagged)
+		block = binary.AppendUvarint(block, pos.seq)
+		prev = key
+	}
+	if block != nil {
+		idx.blocks = append(idx.blocks, block)
+	}
+	return idx
+}
+
+// eachInBlock decodes the entries of block i until fn returns false.
+func (idx *sortedIndex) eachInBlock(i int, fn func(key string, pos recordPos) bool) {
+	block := idx.blocks[i]
+	var key []byte
+	for len(block) > 0 {
+		shared, n := binary.Uvarint(block)
+		block = block[n:]
+		suffix, n := binary.Uvarint(block)
+		block = block[n:]
+		key = append(key[:shared], block[:suffix]...)
+		block = block[suffix:]
+		offset, n := binary.Uvarint(block)
+		block = block[n:]
+		flagged, n := binary.Uvarint(block)
+		block = block[n:]
+		seq, n := binary.Uvarint(block)
+		block = block[n:]
+
+		pos := recordPos{offset: int64(offset), size: int64(flagged >> 1), deleted: flagged&1 != 0, seq: seq}
+		if !fn(string(key), pos) {
+			return
+		}
+	}
+}
+
+func (idx *sortedIndex) get(key string) (recordPos, bool) {
+	i := sort.Search(len(idx.fences), func(i int) bool { return idx.fences[i] > key }) - 1
+	if i < 0 {
+		return recordPos{}, false
+	}
+
+	var (
+		res   recordPos
+		found bool
+	)
+	idx.eachInBlock(i, func(k string, pos recordPos) bool {
+		if c := strings.Compare(k, key); c >= 0 {
+			res, found = pos, c == 0
+			return false
+		}
+		return true
+	})
+	return res, found
+}
+
+func (idx *sortedIndex) each(fn func(key string, pos recordPos)) {
+	for i := range idx.blocks {
+		idx.eachInBlock(i, func(key string, pos recordPos) bool {
+			fn(key, pos)
+			return true
+		})
+	}
+}
+
+// WithCompactIndex keeps the indexes of sealed segments as sorted key blocks rather
+// than hash maps. It saves most of the index memory at the cost of slower lookups.
+func WithCompactIndex() Option {
+	return func(o *options) { o.compactIndex = true }
+}
+
+// seal prepares the index of a segment that will not be written any more: it adds a
+// Bloom filter and, if compact is set, replaces the map with a sortedIndex.
+func (s *FileSegment) seal(compact bool) {
+	s.filter = newBloomFilter(len(s.index))
+	for key := range s.index {
+		s.filter.add(key)
+	}
+	if compact {
+		s.sorted = newSortedIndex(s.index)
+		s.index = nil
+	}
+}
+
+func (s *FileSegment) lookup(key string) (recordPos, bool) {
+	if s.filter != nil && !s.filter.mayContain(key) {
+		return recordPos{}, false
+	}
+	if s.sorted != nil {
+		return s.sorted.get(key)
+	}
+	pos, ok := s.index[key]
+	return pos, ok
+}
+
+func (s *FileSegment) forEach(fn func(key string, pos recordPos)) {
+	if s.sorted != nil {
+		s.sorted.each(fn)
+		return
+	}
+	for key, pos := range s.index {
+		fn(key, pos)
+	}
+}
@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func testIndex(n int) hashInd {
+	index := make(hashInd, n)
+	for i := 0; i < n; i++ {
+		index[fmt.Sprintf("user:%08d", i)] = recordPos{offset: int64(i) * 40, size: 40, deleted: i%7 == 0}
+	}
+	return index
+}
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		f.add(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("Bloom filter lost key%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Expected about 1%% false positives, got %d of 10000", falsePositives)
+	}
+}
+
+func TestSortedIndex(t *testing.T) {
+	index := testIndex(1000)
+	sorted := newSortedIndex(index)
+
+	for key, pos := range index {
+		if got, ok := sorted.get(key); !ok || got != pos {
+			t.Fatalf("Sorted index has %+v, %t for %s, want %+v", got, ok, key, pos)
+		}
+	}
+	for _, key := range []string{"", "a", "user:", "user:00000000a", "user:00000999a", "z"} {
+		if _, ok := sorted.get(key); ok {
+			t.Errorf("Sorted index found missing key %q", key)
+		}
+	}
+
+	var prev string
+	visited := make(hashInd)
+	sorted.each(func(key string, pos recordPos) {
+		if key <= prev {
+			t.Errorf("Keys %s and %s are out of order", prev, key)
+		}
+		prev = key
+		visited[key] = pos
+	})
+	if !reflect.DeepEqual(visited, index) {
+		t.Errorf("Iterating the sorted index returned %d of %d keys", len(visited), len(index))
+	}
+}
+
+func TestCompactIndex(t *testing.T) {
+	db := newTestDb(t, 200, WithCompactIndex(), WithCompactionPolicy(runPolicy{0, 3}))
+
+	for i := 0; i < 50; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%15), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	db.compactions.Wait()
+
+	for _, s := range db.segments[:len(db.segments)-1] {
+		if s.index != nil || s.sorted == nil || s.filter == nil {
+			t.Errorf("Expected sealed segment %d to have a sorted index and a filter", s.id)
+		}
+	}
+	if _, err := db.Get("key3"); err != ErrNotFound {
+		t.Errorf("Expected deleted key3, got %v", err)
+	}
+	expected, err := db.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 14 {
+		t.Errorf("Expected 14 keys, got %v", expected)
+	}
+
+	db.Close()
+	reopened, err := NewDb(db.dir, 200, WithCompactIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for _, kv := range expected {
+		if value, err := reopened.Get(kv.Key); err != nil || value != kv.Value {
+			t.Errorf("Reopened db has %q, %v for %s, want %q", value, err, kv.Key, kv.Value)
+		}
+	}
+}
+
+// heapGrowth returns how many bytes of the heap build keeps reachable.
+func heapGrowth(build func() any) (uint64, any) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	res := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	return after.HeapAlloc - before.HeapAlloc, res
+}
+
+func BenchmarkIndexMemory(b *testing.B) {
+	const keys = 100000
+	for _, bc := range []struct {
+		name  string
+		build func(index hashInd) any
+	}{
+		{"hash", func(index hashInd) any { return index }},
+		{"hash+bloom", func(index hashInd) any {
+			s := &FileSegment{index: index}
+			s.seal(false)
+			return s
+		}},
+		{"sorted+bloom", func(index hashInd) any {
+			s := &FileSegment{index: index}
+			s.seal(true)
+			return s
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var bytes uint64
+			for i := 0; i < b.N; i++ {
+				n, res := heapGrowth(func() any { return bc.build(testIndex(keys)) })
+				runtime.KeepAlive(res)
+				bytes += n
+			}
+			b.ReportMetric(float64(bytes)/float64(b.N)/keys, "bytes/key")
+		})
+	}
+}
+
+func BenchmarkGetMissing(b *testing.B) {
+	const segments = 20
+	for _, compact := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compact=%t", compact), func(b *testing.B) {
+			db := &Db{}
+			for i := 0; i < segments; i++ {
+				s := &FileSegment{id: i, index: testIndex(10000)}
+				s.seal(compact)
+				db.segments = append(db.segments, s)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.get("order:12345"); err != ErrNotFound {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrTornTail marks the end of a segment that cannot be split into records any more,
+// such as a record cut short by a crash. Nothing after it can be trusted.
+var ErrTornTail = fmt.Errorf("unreadable data at the end of the segment")
+
+// RecordInfo describes a record found by WalkSegment. Err is set for a record that
+// cannot be decoded; Record is then filled only as far as it could be read.
+type RecordInfo struct {
+	Record
+	Offset int64
+	Size   int64
+	Err    error
+}
+
+// SegmentFiles returns the segment files of dir in the order NewDb reads them.
+func SegmentFiles(dir string) ([]string, error) {
+	paths, _, err := segmentFiles(dir)
+	return paths, err
+}
+
+// WalkSegment calls fn for every record of the segment file at path. A record with a
+// bad checksum is reported and skipped; the walk ends with ErrTornTail at the first
+// record whose framing is broken. Encrypted values are decrypted with the keys given
+// by WithEncryption; without the key, their records are reported with ErrNoKey.
+func WalkSegment(path string, fn func(RecordInfo) error, opts ...Option) error {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return walkSegment(path, o.keys, func(info RecordInfo, _ []byte) error { return fn(info) })
+}
+
+func walkSegment(path string, keys *Keyring, fn func(info RecordInfo, data []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := stat.Size()
+
+	header, offset, err := readSegmentHeader(f)
+	if err != nil {
+		return err
+	}
+	// Without the key, records are still split and their keys read.
+	aead, _ := keys.aead(header.keyID)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(f, bufSize)
+	for offset < fileSize {
+		tail := RecordInfo{Offset: offset, Size: fileSize - offset, Err: ErrTornTail}
+
+		header, err := in.Peek(4)
+		if err != nil {
+			return fn(tail, nil)
+		}
+		size := int64(binary.LittleEndian.Uint32(header))
+		if size < 4 || offset+size > fileSize {
+			return fn(tail, nil)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return err
+		}
+
+		var e entry
+		info := RecordInfo{Offset: offset, Size: size}
+		info.Err = e.decode(data, aead)
+		if info.Err != nil && info.Err != ErrChecksum && info.Err != ErrNoKey {
+			return fn(tail, nil)
+		}
+		info.Record = Record{Key: e.key, Value: e.value, Deleted: e.deleted}
+		if err := fn(info, data); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// Compact merges all segments of dir into one, dropping overwritten values and
+// tombstones. Torn tails are cut off first, as NewDb would. The result is written with
+// the compression and encryption options given. The db must not be open.
+func Compact(dir string, opts ...Option) error {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	aead, err := o.keys.aead(o.keys.Current())
+	if err != nil {
+		return err
+	}
+	codec := recordCodec{compression: o.compression, keyID: o.keys.Current(), aead: aead}
+
+	paths, numbers, err := segmentFiles(dir)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+
+	segments := make([]*FileSegment, len(paths))
+	for i, path := range paths {
+		segments[i] = &FileSegment{id: numbers[i], outPath: path, index: make(hashInd)}
+		if err := segments[i].load(o.keys, i == len(paths)-1); err != nil {
+			return err
+		}
+	}
+
+	last := paths[len(paths)-1]
+	if _, err := mergeSegments(segments, nil, false, nil, codec, numbers[len(paths)-1], last+mergeSuffix, nil); err != nil {
+		os.Remove(last + mergeSuffix)
+		return err
+	}
+	if err := os.Rename(last+mergeSuffix, last); err != nil {
+		return err
+	}
+	for _, path := range paths[:len(paths)-1] {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RepairResult tells what Repair removed from a segment file.
+type RepairResult struct {
+	Path      string
+	Dropped   int
+	Truncated int64
+}
+
+// Repair removes the records with bad checksums and the torn tails from the segments
+// of dir. An older value of a key whose newest record was dropped becomes visible
+// again. Encrypted records are checked with the keys given by WithEncryption; those
+// whose key is missing are kept. It returns the files that were changed. The db must
+// not be open.
+func Repair(dir string, opts ...Option) ([]RepairResult, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	paths, err := SegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []RepairResult
+	for _, path := range paths {
+		res, err := repairSegment(path, o.keys)
+		if err != nil {
+			return results, fmt.Errorf("repairing %s: %w", path, err)
+		}
+		if res.Dropped > 0 || res.Truncated > 0 {
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
+
+func repairSegment(path string, keys *Keyring) (RepairResult, error) {
+	res := RepairResult{Path: path}
+	f, err := os.Open(path)
+	if err != nil {
+		return res, err
+	}
+	_, start, err := readSegmentHeader(f)
+	header := make([]byte, start)
+	if err == nil {
+		_, err = f.ReadAt(header, 0)
+	}
+	f.Close()
+	if err != nil {
+		return res, err
+	}
+
+	good := [][]byte{header}
+	goodSize := start
+	err = walkSegment(path, keys, func(info RecordInfo, data []byte) error {
+		switch info.Err {
+		case nil, ErrNoKey:
+			good = append(good, data)
+			goodSize += info.Size
+		case ErrTornTail:
+			res.Truncated = info.Size
+		default:
+			res.Dropped++
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	if res.Dropped == 0 {
+		if res.Truncated > 0 {
+			return res, os.Truncate(path, goodSize)
+		}
+		return res, nil
+	}
+
+	tmpPath := path + mergeSuffix
+	f, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return res, err
+	}
+	for _, data := range good {
+		if _, err = f.Write(data); err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return res, err
+	}
+	return res, os.Rename(tmpPath, path)
+}
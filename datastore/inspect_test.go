@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// damagedDb writes a db over several segments, then flips a value byte of the first
+// record of the first segment and appends a torn record to the last one.
+func damagedDb(t *testing.T) (string, []KeyValue) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	first := filepath.Join(dir, outFileName+"0")
+	data, err := ioutil.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[bytes.Index(data, []byte("value0"))] ^= 0xff
+	torn := (&entry{key: "torn", value: "value"}).Encode()
+	data = append(data, torn[:len(torn)-5]...)
+	if err := ioutil.WriteFile(first, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []KeyValue
+	for i := 1; i < 10; i++ {
+		expected = append(expected, KeyValue{Key: fmt.Sprintf("key%d", i), Value: fmt.Sprintf("value%d", i)})
+	}
+	return dir, expected
+}
+
+func TestWalkSegment(t *testing.T) {
+	dir, _ := damagedDb(t)
+
+	var records []RecordInfo
+	err := WalkSegment(filepath.Join(dir, outFileName+"0"), func(r RecordInfo) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 11 {
+		t.Fatalf("Expected 10 records and a torn tail, got %d", len(records))
+	}
+	if records[0].Err != ErrChecksum || records[0].Key != "key0" {
+		t.Errorf("Expected a checksum error for key0, got %+v", records[0])
+	}
+	if records[1].Err != nil || records[1].Offset != records[0].Offset+records[0].Size || records[1].Value != "value1" {
+		t.Errorf("Unexpected second record %+v", records[1])
+	}
+	if tail := records[10]; tail.Err != ErrTornTail || tail.Size == 0 {
+		t.Errorf("Expected a torn tail, got %+v", tail)
+	}
+}
+
+func TestRepairAndCompact(t *testing.T) {
+	dir, expected := damagedDb(t)
+
+	results, err := Repair(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Dropped != 1 || results[0].Truncated == 0 {
+		t.Fatalf("Unexpected repair results %+v", results)
+	}
+	if results, err := Repair(dir); err != nil || len(results) != 0 {
+		t.Errorf("Expected nothing to repair the second time, got %+v, %v", results, err)
+	}
+
+	db, err := NewDb(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), "new"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key5"); err != nil {
+		t.Fatal(err)
+	}
+	expected, err = db.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if err := Compact(dir); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := SegmentFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Errorf("Expected a single segment after compaction, got %v", paths)
+	}
+
+	db, err = NewDb(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	res, err := db.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Compacted db has %v, want %v", res, expected)
+	}
+}
@@ -0,0 +1,71 @@
+package datastore
+
+import "fmt"
+
+// Default limits of WithSizeLimits.
+const (
+	DefaultMaxKeySize   = 4 << 10
+	DefaultMaxValueSize = 16 << 20
+)
+
+// maxRecordValue is the largest value the record format can hold, leaving room for the
+// flate and AES-GCM overhead within valueLenMask.
+const maxRecordValue = valueLenMask - 1<<10
+
+// ErrTooLarge is what a SizeError unwraps to.
+var ErrTooLarge = fmt.Errorf("record is too large")
+
+// SizeError is returned by writes of a key or value over the limit of the store. Nothing
+// of the write is stored.
+type SizeError struct {
+	// Field is "key" or "value".
+	Field string
+	Size  int
+	Limit int
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("%s of %d bytes exceeds the limit of %d bytes", e.Field, e.Size, e.Limit)
+}
+
+func (e *SizeError) Unwrap() error { return ErrTooLarge }
+
+// WithSizeLimits replaces the DefaultMaxKeySize and DefaultMaxValueSize limits of keys
+// and values. Zero keeps the default.
+func WithSizeLimits(maxKey, maxValue int) Option {
+	return func(o *options) {
+		o.maxKeySize = maxKey
+		o.maxValueSize = maxValue
+	}
+}
+
+type sizeLimits struct {
+	maxKey, maxValue int
+}
+
+func newSizeLimits(o options) (sizeLimits, error) {
+	l := sizeLimits{maxKey: o.maxKeySize, maxValue: o.maxValueSize}
+	if l.maxKey <= 0 {
+		l.maxKey = DefaultMaxKeySize
+	}
+	if l.maxValue <= 0 {
+		l.maxValue = DefaultMaxValueSize
+	}
+	if l.maxKey > maxRecordValue || l.maxValue > maxRecordValue {
+		return l, fmt.Errorf("size limits must not exceed %d bytes", maxRecordValue)
+	}
+	return l, nil
+}
+
+// check returns a SizeError for the first entry over the limits.
+func (l sizeLimits) check(entries []entry) error {
+	for i := range entries {
+		if len(entries[i].key) > l.maxKey {
+			return &SizeError{Field: "key", Size: len(entries[i].key), Limit: l.maxKey}
+		}
+		if len(entries[i].value) > l.maxValue {
+			return &SizeError{Field: "value", Size: len(entries[i].value), Limit: l.maxValue}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+var ErrSegmentNotFound = fmt.Errorf("segment does not exist")
+
+// SegmentInfo describes a segment. Live bytes hold the newest values of their keys,
+// dead ones are overwritten or deleted records and tombstones. Records start at Start,
+// after the header with the format Version and the key KeyID of an encrypted segment.
+type SegmentInfo struct {
+	ID      int    `json:"id"`
+	Size    int64  `json:"size"`
+	Live    int64  `json:"live"`
+	Dead    int64  `json:"dead"`
+	Start   int64  `json:"start"`
+	Version int    `json:"version"`
+	KeyID   string `json:"key_id,omitempty"`
+}
+
+// Record is a decoded log record; a deleted record is a tombstone.
+type Record struct {
+	Key     string
+	Value   string
+	Deleted bool
+}
+
+// Segments describes the current segments in the order they are read, oldest first.
+// Sizes only cover completely written records.
+func (db *Db) Segments() []SegmentInfo {
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+
+	res := make([]SegmentInfo, len(db.segments))
+	for i, s := range db.segments {
+		res[i] = s.info()
+	}
+	return res
+}
+
+func (s *FileSegment) info() SegmentInfo {
+	return SegmentInfo{ID: s.id, Size: s.size, Live: s.live, Dead: s.size - s.start - s.live, Start: s.start, Version: int(s.version), KeyID: s.keyID}
+}
+
+// ReadSegment returns the raw records of the segment from offset up to its current size.
+func (db *Db) ReadSegment(id int, offset int64) ([]byte, error) {
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+
+	var segment *FileSegment
+	for _, s := range db.segments {
+		if s.id == id {
+			segment = s
+		}
+	}
+	if segment == nil {
+		return nil, ErrSegmentNotFound
+	}
+	if offset < segment.start || offset > segment.size {
+		return nil, fmt.Errorf("offset %d is out of segment bounds", offset)
+	}
+
+	f, err := os.Open(segment.outPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, segment.size-offset)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DecodeLog decodes the complete records at the start of data. It returns them along
+// with the number of bytes they take, so a trailing partial record can be read later.
+func DecodeLog(data []byte) ([]Record, int, error) {
+	return decodeLog(data, nil)
+}
+
+// DecodeSegment is DecodeLog for records read from the segment described by info,
+// which may be encrypted with a key of the db.
+func (db *Db) DecodeSegment(info SegmentInfo, data []byte) ([]Record, int, error) {
+	if info.Version > segmentVersion {
+		return nil, 0, fmt.Errorf("%w %d", ErrUnsupportedVersion, info.Version)
+	}
+	aead, err := db.keys.aead(info.KeyID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeLog(data, aead)
+}
+
+func decodeLog(data []byte, aead cipher.AEAD) ([]Record, int, error) {
+	var (
+		records []Record
+		n       int
+	)
+	for len(data)-n >= 4 {
+		size := int(binary.LittleEndian.Uint32(data[n:]))
+		if size < 4 {
+			return records, n, fmt.Errorf("bad record size %d at offset %d", size, n)
+		}
+		if len(data)-n < size {
+			break
+		}
+
+		var e entry
+		if err := e.decode(data[n:n+size], aead); err != nil {
+			return records, n, fmt.Errorf("bad record at offset %d: %w", n, err)
+		}
+		records = append(records, Record{Key: e.key, Value: e.value, Deleted: e.deleted})
+		n += size
+	}
+	return records, n, nil
+}
@@ -0,0 +1,681 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	walSuffix   = ".wal"
+	tableSuffix = ".sst"
+
+	defaultMemtableSize = 1 << 20
+	// l0Tables flushed memtables are merged into level 1 together.
+	l0Tables = 4
+	// levelRatio is how many times every level from level 1 on may outgrow the memtable
+	// size of the level above.
+	levelRatio = 10
+)
+
+// WithMemtableSize sets how many bytes of records the LSM engine buffers before it
+// writes them to a table. It is also the size of the tables written by merges.
+func WithMemtableSize(size int64) Option {
+	return func(o *options) { o.memtableSize = size }
+}
+
+// lsmManifest lists the tables of every level by file number, level 0 oldest first.
+// Logs numbered below LogNumber are in the tables already.
+type lsmManifest struct {
+	NextFile  int64   `json:"next_file"`
+	LogNumber int64   `json:"log_number"`
+	Levels    [][]int `json:"levels"`
+}
+
+// LSM is a storage engine that keeps recent writes in a memtable backed by a write-ahead
+// log and flushes it to tables sorted by key. Level 0 holds flushed memtables, which may
+// overlap. Every further level is a sorted run of tables levelRatio times larger than
+// the level above, and merges move tables one level down at a time. Only the block
+// indexes and Bloom filters of the tables stay in memory.
+type LSM struct {
+	dir          string
+	memtableSize int64
+	compression  int
+	limits       sizeLimits
+	nextFile     atomic.Int64
+
+	mutex   sync.RWMutex
+	mem     map[string]entry
+	memSize int64
+	wal     *os.File
+	walNum  int64
+	levels  [][]*table
+	// pointers hold the last key merged out of every level, so that merges take the
+	// tables of a level in turn.
+	pointers map[int]string
+
+	compactMutex sync.Mutex
+	compactions  sync.WaitGroup
+}
+
+func NewLSM(dir string, opts ...Option) (*LSM, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.memtableSize <= 0 {
+		o.memtableSize = defaultMemtableSize
+	}
+	if o.keys != nil {
+		return nil, fmt.Errorf("the LSM engine does not support encryption")
+	}
+	limits, err := newSizeLimits(o)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &LSM{
+		dir:          dir,
+		memtableSize: o.memtableSize,
+		compression:  o.compression,
+		limits:       limits,
+		mem:          make(map[string]entry),
+		pointers:     make(map[int]string),
+	}
+	if err := l.open(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LSM) fileName(num int64, suffix string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%06d%s", num, suffix))
+}
+
+// files returns the numbers of the files in the directory with suffix in ascending order.
+func (l *LSM) files(suffix string) ([]int64, error) {
+	paths, err := filepath.Glob(filepath.Join(l.dir, "*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	var nums []int64
+	for _, path := range paths {
+		if num, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), suffix), 10, 64); err == nil {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+// open loads the tables of the manifest, replays the logs that are not in them yet and
+// flushes the result, so that writing starts with an empty memtable and a new log.
+func (l *LSM) open() error {
+	var m lsmManifest
+	data, err := os.ReadFile(filepath.Join(l.dir, manifestName))
+	if err == nil {
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("reading %s: %w", manifestName, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	l.nextFile.Store(m.NextFile)
+
+	listed := make(map[int64]bool)
+	l.levels = make([][]*table, max(len(m.Levels), 1))
+	for level, nums := range m.Levels {
+		for _, num := range nums {
+			t, err := openTable(l.fileName(int64(num), tableSuffix), num)
+			if err != nil {
+				return err
+			}
+			l.levels[level] = append(l.levels[level], t)
+			listed[int64(num)] = true
+		}
+	}
+
+	// Tables of an interrupted flush or merge are not in the manifest.
+	tables, err := l.files(tableSuffix)
+	if err != nil {
+		return err
+	}
+	for _, num := range tables {
+		if !listed[num] {
+			os.Remove(l.fileName(num, tableSuffix))
+		}
+	}
+
+	logs, err := l.files(walSuffix)
+	if err != nil {
+		return err
+	}
+	for _, num := range logs {
+		if num >= m.LogNumber {
+			if err := l.replay(l.fileName(num, walSuffix)); err != nil {
+				return err
+			}
+		}
+	}
+	return l.flush()
+}
+
+// replay applies the complete batches of a log to the memtable.
+func (l *LSM) replay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(f, bufSize)
+	var offset int64
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(in, header); err != nil {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(header))
+		if offset+8+size > stat.Size() {
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(in, payload); err != nil || crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+		records, n, err := DecodeLog(payload)
+		if err != nil || n != len(payload) {
+			break
+		}
+		for _, r := range records {
+			l.apply(entry{key: r.Key, value: r.Value, deleted: r.Deleted})
+		}
+		offset += 8 + size
+	}
+
+	if offset < stat.Size() {
+		log.Printf("Dropping %d corrupted bytes at the tail of %s", stat.Size()-offset, path)
+	}
+	return nil
+}
+
+func (l *LSM) apply(e entry) {
+	l.mem[e.key] = e
+	l.memSize += int64(len(e.key) + len(e.value) + 32)
+}
+
+// writeManifest replaces the manifest atomically. It is called with the lock held.
+func (l *LSM) writeManifest(logNumber int64) error {
+	m := lsmManifest{NextFile: l.nextFile.Load(), LogNumber: logNumber}
+	for _, tables := range l.levels {
+		nums := make([]int, len(tables))
+		for i, t := range tables {
+			nums[i] = t.num
+		}
+		m.Levels = append(m.Levels, nums)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(l.dir, manifestName)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return err
+}
+
+// flush writes the memtable to level 0 and switches to a new log. It is called with the
+// lock held. The old logs are removed once the manifest lists the new table.
+func (l *LSM) flush() error {
+	var flushed []*table
+	if len(l.mem) > 0 {
+		it := l.sortedMem("")
+		var err error
+		if flushed, err = l.writeTables(&it, false); err != nil {
+			return err
+		}
+	}
+
+	walNum := l.nextFile.Add(1) - 1
+	wal, err := os.OpenFile(l.fileName(walNum, walSuffix), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err == nil {
+		l.levels[0] = append(l.levels[0], flushed...)
+		if err = l.writeManifest(walNum); err != nil {
+			l.levels[0] = l.levels[0][:len(l.levels[0])-len(flushed)]
+			wal.Close()
+			os.Remove(wal.Name())
+		}
+	}
+	if err != nil {
+		removeTables(flushed)
+		return err
+	}
+
+	if l.wal != nil {
+		l.wal.Close()
+	}
+	l.wal, l.walNum = wal, walNum
+	l.mem = make(map[string]entry)
+	l.memSize = 0
+	if logs, err := l.files(walSuffix); err == nil {
+		for _, num := range logs {
+			if num < walNum {
+				os.Remove(l.fileName(num, walSuffix))
+			}
+		}
+	}
+
+	l.maybeCompact()
+	return nil
+}
+
+func removeTables(tables []*table) {
+	for _, t := range tables {
+		t.close()
+		os.Remove(t.path)
+	}
+}
+
+// sortedMem returns the memtable records with keys starting with prefix in key order.
+func (l *LSM) sortedMem(prefix string) sliceIter {
+	var res sliceIter
+	for key, e := range l.mem {
+		if strings.HasPrefix(key, prefix) {
+			res = append(res, e)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].key < res[j].key })
+	return res
+}
+
+// writeTables writes the records of it to new tables of about memtableSize bytes each.
+func (l *LSM) writeTables(it entryIterator, dropTombstones bool) ([]*table, error) {
+	var (
+		tables []*table
+		w      *tableWriter
+	)
+	finish := func() error {
+		t, err := w.finish()
+		if err != nil {
+			os.Remove(w.path)
+			return err
+		}
+		tables = append(tables, t)
+		w = nil
+		return nil
+	}
+	fail := func(err error) ([]*table, error) {
+		if w != nil {
+			w.abort()
+		}
+		removeTables(tables)
+		return nil, err
+	}
+
+	for {
+		e, ok, err := it.next()
+		if err != nil {
+			return fail(err)
+		}
+		if !ok {
+			break
+		}
+		if e.deleted && dropTombstones {
+			continue
+		}
+		if w == nil {
+			num := l.nextFile.Add(1) - 1
+			if w, err = newTableWriter(l.fileName(num, tableSuffix), int(num), l.compression); err != nil {
+				return fail(err)
+			}
+		}
+		if err := w.add(e); err != nil {
+			return fail(err)
+		}
+		if w.offset >= l.memtableSize {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	return tables, nil
+}
+
+func (l *LSM) Get(key string) (string, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	e, ok, err := l.get(key)
+	if err != nil {
+		return "", err
+	}
+	if !ok || e.deleted {
+		return "", ErrNotFound
+	}
+	return e.value, nil
+}
+
+// get returns the newest record of key: from the memtable, then from level 0 newest
+// first, then from the one table of every further level whose range holds the key.
+func (l *LSM) get(key string) (entry, bool, error) {
+	if e, ok := l.mem[key]; ok {
+		return e, true, nil
+	}
+	for i := len(l.levels[0]) - 1; i >= 0; i-- {
+		if e, ok, err := l.levels[0][i].get(key); err != nil || ok {
+			return e, ok, err
+		}
+	}
+	for _, tables := range l.levels[1:] {
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].last >= key })
+		if i == len(tables) {
+			continue
+		}
+		if e, ok, err := tables[i].get(key); err != nil || ok {
+			return e, ok, err
+		}
+	}
+	return entry{}, false, nil
+}
+
+func (l *LSM) Put(key, value string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.write(entry{key: key, value: value})
+}
+
+// Delete writes a tombstone for the key. It returns ErrNotFound if the key has no value.
+func (l *LSM) Delete(key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	e, ok, err := l.get(key)
+	if err != nil {
+		return err
+	}
+	if !ok || e.deleted {
+		return ErrNotFound
+	}
+	return l.write(entry{key: key, deleted: true})
+}
+
+// Write applies all operations of the batch with a single append to the log.
+func (l *LSM) Write(b *WriteBatch) error {
+	if len(b.entries) == 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.write(b.entries...)
+}
+
+// write appends the entries to the log as one batch, framed by its length and CRC-32,
+// so that a torn batch is dropped as a whole on replay.
+func (l *LSM) write(entries ...entry) error {
+	if err := l.limits.check(entries); err != nil {
+		return err
+	}
+	if l.memSize >= l.memtableSize {
+		if err := l.flush(); err != nil {
+			return err
+		}
+	}
+
+	frame := make([]byte, 8)
+	for i := range entries {
+		frame = append(frame, entries[i].encode(recordCodec{compression: l.compression})...)
+	}
+	binary.LittleEndian.PutUint32(frame, uint32(len(frame)-8))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(frame[8:]))
+	if _, err := l.wal.Write(frame); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		l.apply(e)
+	}
+	return nil
+}
+
+// Scan returns the live records whose keys start with prefix, sorted by key. It merges
+// the memtable with the tables that may hold such keys, reading from the first block
+// that may hold the prefix.
+func (l *LSM) Scan(prefix string) ([]KeyValue, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	mem := l.sortedMem(prefix)
+	its := []entryIterator{&mem}
+	for i := len(l.levels[0]) - 1; i >= 0; i-- {
+		its = append(its, l.levels[0][i].iter(prefix))
+	}
+	for _, tables := range l.levels[1:] {
+		for _, t := range tables {
+			if t.last >= prefix && (t.first() <= prefix || strings.HasPrefix(t.first(), prefix)) {
+				its = append(its, t.iter(prefix))
+			}
+		}
+	}
+
+	m, err := newMergeIter(its)
+	if err != nil {
+		return nil, err
+	}
+	var res []KeyValue
+	for {
+		e, ok, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok || e.key > prefix && !strings.HasPrefix(e.key, prefix) {
+			break
+		}
+		if !e.deleted && strings.HasPrefix(e.key, prefix) {
+			res = append(res, KeyValue{Key: e.key, Value: e.value})
+		}
+	}
+	return res, nil
+}
+
+func (l *LSM) Close() {
+	l.compactions.Wait()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.wal != nil {
+		l.wal.Close()
+	}
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			t.close()
+		}
+	}
+}
+
+// lsmMerge merges inputs of level into the overlapping tables of the next level.
+type lsmMerge struct {
+	level       int
+	inputs      []*table
+	overlapping []*table
+	// bottom is set when no level below the output holds data, so tombstones can go.
+	bottom bool
+}
+
+func (l *LSM) levelLimit(level int) int64 {
+	limit := l.memtableSize
+	for i := 0; i < level; i++ {
+		limit *= levelRatio
+	}
+	return limit
+}
+
+// pick chooses the next merge: all of level 0 once it has l0Tables tables, otherwise
+// the next table of the first level over its limit. It is called with the read lock.
+func (l *LSM) pick() *lsmMerge {
+	c := &lsmMerge{}
+	if len(l.levels[0]) >= l0Tables {
+		for i := len(l.levels[0]) - 1; i >= 0; i-- {
+			c.inputs = append(c.inputs, l.levels[0][i])
+		}
+	}
+	for level := 1; level < len(l.levels) && c.inputs == nil; level++ {
+		var size int64
+		for _, t := range l.levels[level] {
+			size += t.size
+		}
+		if size <= l.levelLimit(level) {
+			continue
+		}
+		tables := l.levels[level]
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].first() > l.pointers[level] })
+		if i == len(tables) {
+			i = 0
+		}
+		c.level, c.inputs = level, []*table{tables[i]}
+	}
+	if c.inputs == nil {
+		return nil
+	}
+
+	first, last := c.inputs[0].first(), c.inputs[0].last
+	for _, t := range c.inputs[1:] {
+		first, last = min(first, t.first()), max(last, t.last)
+	}
+	c.bottom = true
+	for level := c.level + 1; level < len(l.levels); level++ {
+		if level > c.level+1 && len(l.levels[level]) > 0 {
+			c.bottom = false
+		}
+	}
+	if c.level+1 < len(l.levels) {
+		for _, t := range l.levels[c.level+1] {
+			if t.overlaps(first, last) {
+				c.overlapping = append(c.overlapping, t)
+			}
+		}
+	}
+	return c
+}
+
+// maybeCompact starts merging in the background unless a merge is in progress. It is
+// called with the lock held.
+func (l *LSM) maybeCompact() {
+	if !l.compactMutex.TryLock() {
+		return
+	}
+	l.compactions.Add(1)
+	go func() {
+		defer l.compactions.Done()
+		defer l.compactMutex.Unlock()
+		if err := l.compact(); err != nil {
+			log.Printf("Failed to merge tables: %s", err)
+		}
+	}()
+}
+
+// compact merges tables until every level is within its limit. Tables never change, so
+// they are read without the lock; flushes only add tables to level 0 meanwhile.
+func (l *LSM) compact() error {
+	for {
+		l.mutex.RLock()
+		c := l.pick()
+		l.mutex.RUnlock()
+		if c == nil {
+			return nil
+		}
+		if err := l.merge(c); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *LSM) merge(c *lsmMerge) error {
+	var its []entryIterator
+	for _, t := range append(c.inputs, c.overlapping...) {
+		its = append(its, t.iter(""))
+	}
+	m, err := newMergeIter(its)
+	if err != nil {
+		return err
+	}
+	outputs, err := l.writeTables(m, c.bottom)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	prev := l.levels
+	l.levels = append([][]*table(nil), prev...)
+	if len(l.levels) == c.level+1 {
+		l.levels = append(l.levels, nil)
+	}
+	l.levels[c.level] = without(l.levels[c.level], c.inputs)
+	next := append(without(l.levels[c.level+1], c.overlapping), outputs...)
+	sort.Slice(next, func(i, j int) bool { return next[i].first() < next[j].first() })
+	l.levels[c.level+1] = next
+	err = l.writeManifest(l.walNum)
+	if err != nil {
+		l.levels = prev
+	} else if c.level > 0 {
+		l.pointers[c.level] = c.inputs[0].last
+	}
+	l.mutex.Unlock()
+
+	if err != nil {
+		removeTables(outputs)
+		return err
+	}
+	// Readers hold the lock while they use tables, so none can use the merged ones now.
+	removeTables(c.inputs)
+	removeTables(c.overlapping)
+	return nil
+}
+
+func without(tables, removed []*table) []*table {
+	drop := make(map[*table]bool, len(removed))
+	for _, t := range removed {
+		drop[t] = true
+	}
+	var res []*table
+	for _, t := range tables {
+		if !drop[t] {
+			res = append(res, t)
+		}
+	}
+	return res
+}
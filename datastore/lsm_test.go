@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestLSM(t *testing.T, memtableSize int64) (*LSM, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "test-lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := NewLSM(dir, WithMemtableSize(memtableSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, dir
+}
+
+func TestLSMLevels(t *testing.T) {
+	l, _ := newTestLSM(t, 512)
+	defer l.Close()
+
+	for i := 0; i < 3000; i++ {
+		if err := l.Put(fmt.Sprintf("key%04d", i%700), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.compactions.Wait()
+
+	l.mutex.RLock()
+	if len(l.levels) < 3 {
+		t.Errorf("Expected data to reach level 2, got %d levels", len(l.levels))
+	}
+	if len(l.levels[0]) >= l0Tables {
+		t.Errorf("Expected level 0 to be merged, it has %d tables", len(l.levels[0]))
+	}
+	for level, tables := range l.levels[1:] {
+		for i := 1; i < len(tables); i++ {
+			if tables[i-1].last >= tables[i].first() {
+				t.Errorf("Tables %d and %d of level %d overlap", i-1, i, level+1)
+			}
+		}
+	}
+	l.mutex.RUnlock()
+
+	res, err := l.Scan("key01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 100 || res[0].Key != "key0100" || res[99].Key != "key0199" {
+		t.Errorf("Unexpected range scan of %d records", len(res))
+	}
+	for i := 2300; i < 3000; i++ {
+		key, value := fmt.Sprintf("key%04d", i%700), fmt.Sprintf("value%d", i)
+		if res, err := l.Get(key); err != nil || res != value {
+			t.Fatalf("Got %q, %v for %s, want %q", res, err, key, value)
+		}
+	}
+}
+
+func TestLSMRecovery(t *testing.T) {
+	l, dir := newTestLSM(t, 1<<20)
+	for i := 0; i < 10; i++ {
+		if err := l.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walPath := l.wal.Name()
+	l.Close()
+
+	// A torn batch at the end of the log and a table left by an interrupted merge.
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1, 2, 3, 4, 5})
+	f.Close()
+	leftover := filepath.Join(dir, "999999"+tableSuffix)
+	if err := ioutil.WriteFile(leftover, []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = NewLSM(dir, WithMemtableSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	res, err := l.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 10 {
+		t.Errorf("Expected 10 records after recovery, got %v", res)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Expected the unlisted table to be removed, got %v", err)
+	}
+	if _, err := os.Stat(walPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the replayed log to be removed after the flush, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// Snapshot is a consistent view of the db as of the moment it was taken. Reads through
+// it see none of the later writes, and compaction keeps the records it reads until it
+// is released.
+type Snapshot struct {
+	db   *Db
+	seq  uint64
+	once sync.Once
+}
+
+// NewSnapshot pins the sequence number of the last write. The snapshot must be released.
+func (db *Db) NewSnapshot() *Snapshot {
+	db.indexMutex.Lock()
+	defer db.indexMutex.Unlock()
+	db.snapshots[db.seq]++
+	return &Snapshot{db: db, seq: db.seq}
+}
+
+func (s *Snapshot) Get(key string) (string, error) {
+	s.db.indexMutex.RLock()
+	defer s.db.indexMutex.RUnlock()
+	return s.db.getAt(key, s.seq)
+}
+
+// Scan returns the records whose keys start with prefix as of the snapshot, sorted by key.
+func (s *Snapshot) Scan(prefix string) ([]KeyValue, error) {
+	s.db.indexMutex.RLock()
+	defer s.db.indexMutex.RUnlock()
+	return s.db.scanAt(prefix, s.seq)
+}
+
+// Release lets compaction drop the records only the snapshot reads. It may be called
+// more than once.
+func (s *Snapshot) Release() {
+	s.once.Do(func() {
+		s.db.indexMutex.Lock()
+		defer s.db.indexMutex.Unlock()
+		if s.db.snapshots[s.seq]--; s.db.snapshots[s.seq] == 0 {
+			delete(s.db.snapshots, s.seq)
+		}
+	})
+}
+
+// pinned reports whether a snapshot reads at or after seq. It is called with the index
+// lock held.
+func (db *Db) pinned(seq uint64) bool {
+	for s := range db.snapshots {
+		if s >= seq {
+			return true
+		}
+	}
+	return false
+}
+
+// pinnedSeqs returns the sequence numbers of the live snapshots in ascending order.
+func (db *Db) pinnedSeqs() []uint64 {
+	res := make([]uint64, 0, len(db.snapshots))
+	for s := range db.snapshots {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// visible reports whether a snapshot in pinned reads a record written at seq and
+// overwritten at next.
+func visible(pinned []uint64, seq, next uint64) bool {
+	i := sort.Search(len(pinned), func(i int) bool { return pinned[i] >= seq })
+	return i < len(pinned) && pinned[i] < next
+}
+
+// lookupAt returns the newest record of key in the segment written up to seq.
+func (s *FileSegment) lookupAt(key string, seq uint64) (recordPos, bool) {
+	pos, ok := s.lookup(key)
+	if !ok || pos.seq <= seq {
+		return pos, ok
+	}
+	versions := s.history[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].seq <= seq {
+			return versions[i], true
+		}
+	}
+	return recordPos{}, false
+}
+
+// versions returns the records of key in the segment, oldest first.
+func (s *FileSegment) versions(key string) []recordPos {
+	pos, ok := s.lookup(key)
+	if !ok {
+		return nil
+	}
+	return append(append([]recordPos(nil), s.history[key]...), pos)
+}
+
+// firstSeq returns the sequence number of the oldest record of key in segments, or
+// math.MaxUint64 if there is none.
+func firstSeq(segments []*FileSegment, key string) uint64 {
+	for _, s := range segments {
+		if versions := s.versions(key); len(versions) > 0 {
+			return versions[0].seq
+		}
+	}
+	return math.MaxUint64
+}
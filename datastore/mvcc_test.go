@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := newTestDb(t, 300, WithCompactionPolicy(runPolicy{0, 100}))
+
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	b := new(WriteBatch)
+	b.Put("key0", "batch")
+	b.Put("added", "batch")
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	// Overwrites in the same segment and in later ones.
+	for i := 0; i < 30; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", 2+i%3), fmt.Sprintf("new%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []KeyValue{{"key0", "old"}, {"key1", "old"}, {"key2", "old"}, {"key3", "old"}, {"key4", "old"}}
+	check := func(when string) {
+		t.Helper()
+		res, err := snapshot.Scan("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("Unexpected snapshot %s: %v", when, res)
+		}
+		if _, err := snapshot.Get("added"); err != ErrNotFound {
+			t.Errorf("Expected a later write to be invisible %s, got %v", when, err)
+		}
+		if value, err := snapshot.Get("key1"); err != nil || value != "old" {
+			t.Errorf("Unexpected deleted value %q, %v %s", value, err, when)
+		}
+	}
+	check("before compaction")
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction")
+
+	if value, err := db.Get("key0"); err != nil || value != "batch" {
+		t.Errorf("Unexpected latest value %q, %v", value, err)
+	}
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Expected the latest view to miss key1, got %v", err)
+	}
+
+	// Once released, compaction drops the versions the snapshot read.
+	before := db.Segments()[0].Size
+	snapshot.Release()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if after := db.Segments()[0].Size; after >= before {
+		t.Errorf("Expected compaction to drop old versions, size went from %d to %d", before, after)
+	}
+	if len(db.snapshots) != 0 || db.segments[0].history != nil {
+		t.Errorf("Expected no history without snapshots, got %v", db.segments[0].history)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	db := newTestDb(t, 1<<20)
+	for i := 0; i < 3; i++ {
+		if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	reopened, err := NewDb(db.dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.seq != 3 {
+		t.Errorf("Expected to continue after sequence number 3, got %d", reopened.seq)
+	}
+	if err := reopened.Put("key", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	pos, _ := reopened.segments[len(reopened.segments)-1].lookup("key")
+	if pos.seq != 4 {
+		t.Errorf("Expected sequence number 4, got %d", pos.seq)
+	}
+
+	var e entry
+	if err := e.Decode((&entry{key: "key", value: "value", seq: 42}).encode(recordCodec{compression: 1})); err != nil || e.seq != 42 || e.value != "value" {
+		t.Errorf("Unexpected decoded entry %+v, %v", e, err)
+	}
+}
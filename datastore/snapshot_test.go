@@ -0,0 +1,132 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 60; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%15), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := db.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := db.Snapshot(&archive); err != nil {
+		t.Fatal(err)
+	}
+	// Writes after the snapshot are not part of it.
+	for i := 0; i < 30; i++ {
+		if err := db.Put(fmt.Sprintf("later%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restoreDir := filepath.Join(dir, "restored")
+	if err := Restore(bytes.NewReader(archive.Bytes()), restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewDb(restoreDir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	res, err := restored.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Restored data %v, want %v", res, expected)
+	}
+
+	if err := Restore(bytes.NewReader(archive.Bytes()), restoreDir); err == nil {
+		t.Error("Expected Restore into a non-empty directory to fail")
+	}
+	if err := Restore(bytes.NewReader([]byte("not an archive")), filepath.Join(dir, "bad")); err == nil {
+		t.Error("Expected Restore of a malformed archive to fail")
+	}
+}
+
+func TestReopenSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 80; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%9), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%20 == 0 {
+			db.compactions.Wait()
+		}
+	}
+	if err := db.Delete("key4"); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := db.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A merge interrupted by a crash leaves a partial file behind.
+	if err := ioutil.WriteFile(filepath.Join(dir, outFileName+"0"+mergeSuffix), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	res, err := db.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Reopened db has %v, want %v", res, expected)
+	}
+	if _, err := os.Stat(filepath.Join(dir, outFileName+"0"+mergeSuffix)); !os.IsNotExist(err) {
+		t.Error("Expected the partial merge file to be removed")
+	}
+
+	if err := db.Put("key0", "after reopen"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key0"); err != nil || value != "after reopen" {
+		t.Errorf("Unexpected value after reopening: %q, %v", value, err)
+	}
+}
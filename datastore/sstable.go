@@ -0,0 +1,358 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A table file of the LSM engine holds records sorted by key, in the same encoding as
+// the log. They are grouped in blocks of about tableBlockSize bytes. The records are
+// followed by an index with the first key, offset and size of every block and the last
+// key of the table, then by a Bloom filter of the keys and a footer with the offsets of
+// the index and the filter.
+const (
+	tableBlockSize         = 4096
+	tableMagic      uint64 = 0x6c736d7461626c65
+	tableFooterSize        = 24
+)
+
+type tableFence struct {
+	key          string
+	offset, size int64
+}
+
+// table is an open table file. Only the index and the filter are kept in memory.
+type table struct {
+	num      int
+	path     string
+	f        *os.File
+	size     int64
+	dataSize int64
+	fences   []tableFence
+	last     string
+	filter   *bloomFilter
+}
+
+type tableWriter struct {
+	compression int
+	f           *os.File
+	w           *bufio.Writer
+	path        string
+	num         int
+	offset      int64
+	fences      []tableFence
+	hashes      []uint64
+	last        string
+}
+
+func newTableWriter(path string, num, compression int) (*tableWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{compression: compression, f: f, w: bufio.NewWriterSize(f, bufSize), path: path, num: num}, nil
+}
+
+// add appends a record. Records must be added in the order of their keys.
+func (w *tableWriter) add(e entry) error {
+	if n := len(w.fences); n == 0 || w.offset-w.fences[n-1].offset >= tableBlockSize {
+		w.finishBlock()
+		w.fences = append(w.fences, tableFence{key: e.key, offset: w.offset})
+	}
+	data := e.encode(recordCodec{compression: w.compression})
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.offset += int64(len(data))
+	w.hashes = append(w.hashes, bloomHash(e.key))
+	w.last = e.key
+	return nil
+}
+
+func (w *tableWriter) finishBlock() {
+	if n := len(w.fences); n > 0 {
+		w.fences[n-1].size = w.offset - w.fences[n-1].offset
+	}
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// finish writes the index, the filter and the footer and opens the table for reading.
+func (w *tableWriter) finish() (*table, error) {
+	w.finishBlock()
+	filter := newBloomFilter(len(w.hashes))
+	for _, h := range w.hashes {
+		filter.addHash(h)
+	}
+
+	var meta []byte
+	meta = binary.LittleEndian.AppendUint32(meta, uint32(len(w.fences)))
+	for _, fence := range w.fences {
+		meta = appendString(meta, fence.key)
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(fence.offset))
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(fence.size))
+	}
+	meta = appendString(meta, w.last)
+	filterOffset := w.offset + int64(len(meta))
+	meta = binary.LittleEndian.AppendUint32(meta, filter.k)
+	meta = binary.LittleEndian.AppendUint32(meta, uint32(len(filter.bits)))
+	for _, word := range filter.bits {
+		meta = binary.LittleEndian.AppendUint64(meta, word)
+	}
+	meta = binary.LittleEndian.AppendUint64(meta, uint64(w.offset))
+	meta = binary.LittleEndian.AppendUint64(meta, uint64(filterOffset))
+	meta = binary.LittleEndian.AppendUint64(meta, tableMagic)
+
+	_, err := w.w.Write(meta)
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return openTable(w.path, w.num)
+}
+
+// abort removes a table that could not be written completely.
+func (w *tableWriter) abort() {
+	w.f.Close()
+	os.Remove(w.path)
+}
+
+func openTable(path string, num int) (*table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTableMeta(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading table %s: %w", path, err)
+	}
+	t.num, t.path, t.f = num, path, f
+	return t, nil
+}
+
+func readTableMeta(f *os.File) (*table, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size < tableFooterSize {
+		return nil, fmt.Errorf("table is too short (%d bytes)", size)
+	}
+	footer := make([]byte, tableFooterSize)
+	if _, err := f.ReadAt(footer, size-tableFooterSize); err != nil {
+		return nil, err
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer))
+	filterOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+	if binary.LittleEndian.Uint64(footer[16:]) != tableMagic || indexOffset > filterOffset || filterOffset > size-tableFooterSize {
+		return nil, fmt.Errorf("bad table footer")
+	}
+
+	meta := make([]byte, size-tableFooterSize-indexOffset)
+	if _, err := f.ReadAt(meta, indexOffset); err != nil {
+		return nil, err
+	}
+	r := metaReader{buf: meta}
+	t := &table{size: size, dataSize: indexOffset}
+	n := r.uint32()
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		fence := tableFence{key: r.string()}
+		fence.offset = int64(r.uint64())
+		fence.size = int64(r.uint64())
+		t.fences = append(t.fences, fence)
+	}
+	t.last = r.string()
+	t.filter = &bloomFilter{k: r.uint32()}
+	words := r.uint32()
+	if uint64(words)*8 != uint64(len(r.buf)) {
+		return nil, fmt.Errorf("bad table filter")
+	}
+	t.filter.bits = make([]uint64, words)
+	for i := range t.filter.bits {
+		t.filter.bits[i] = r.uint64()
+	}
+	if r.err != nil || len(t.fences) == 0 || len(t.filter.bits) == 0 {
+		return nil, fmt.Errorf("bad table index")
+	}
+	return t, nil
+}
+
+// metaReader decodes the index and the filter of a table, remembering the first error.
+type metaReader struct {
+	buf []byte
+	err error
+}
+
+func (r *metaReader) next(n int) []byte {
+	if r.err != nil || n > len(r.buf) {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	res := r.buf[:n]
+	r.buf = r.buf[n:]
+	return res
+}
+
+func (r *metaReader) uint32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *metaReader) uint64() uint64 { return binary.LittleEndian.Uint64(r.next(8)) }
+
+func (r *metaReader) string() string {
+	n := r.uint32()
+	if r.err != nil || uint64(n) > uint64(len(r.buf)) {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (t *table) first() string { return t.fences[0].key }
+
+func (t *table) overlaps(first, last string) bool {
+	return t.first() <= last && first <= t.last
+}
+
+// block returns the index of the block that may hold key, or -1 if key is before all.
+func (t *table) block(key string) int {
+	return sort.Search(len(t.fences), func(i int) bool { return t.fences[i].key > key }) - 1
+}
+
+func (t *table) get(key string) (entry, bool, error) {
+	if key < t.first() || key > t.last || !t.filter.mayContain(key) {
+		return entry{}, false, nil
+	}
+	fence := t.fences[t.block(key)]
+	data := make([]byte, fence.size)
+	if _, err := t.f.ReadAt(data, fence.offset); err != nil {
+		return entry{}, false, err
+	}
+	for len(data) >= 8 {
+		size := binary.LittleEndian.Uint32(data)
+		kl := binary.LittleEndian.Uint32(data[4:])
+		if size < 8 || uint64(size) > uint64(len(data)) || uint64(kl)+8 > uint64(size) {
+			return entry{}, false, fmt.Errorf("corrupted block in %s", t.path)
+		}
+		if string(data[8:8+kl]) == key {
+			var e entry
+			err := e.Decode(data[:size])
+			return e, err == nil, err
+		}
+		data = data[size:]
+	}
+	return entry{}, false, nil
+}
+
+// iter returns the records of the table from the block that may hold start on.
+func (t *table) iter(start string) entryIterator {
+	offset := t.fences[max(t.block(start), 0)].offset
+	section := io.NewSectionReader(t.f, offset, t.dataSize-offset)
+	return &tableIter{in: bufio.NewReaderSize(section, bufSize), path: t.path}
+}
+
+func (t *table) close() { t.f.Close() }
+
+// entryIterator returns records in the order of their keys until ok is false.
+type entryIterator interface {
+	next() (e entry, ok bool, err error)
+}
+
+type tableIter struct {
+	in   *bufio.Reader
+	path string
+}
+
+func (it *tableIter) next() (entry, bool, error) {
+	header, err := it.in.Peek(4)
+	if err == io.EOF {
+		return entry{}, false, nil
+	}
+	if err != nil {
+		return entry{}, false, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header))
+	if _, err := io.ReadFull(it.in, data); err != nil {
+		return entry{}, false, fmt.Errorf("reading %s: %w", it.path, err)
+	}
+	var e entry
+	if err := e.Decode(data); err != nil {
+		return entry{}, false, fmt.Errorf("reading %s: %w", it.path, err)
+	}
+	return e, true, nil
+}
+
+type sliceIter []entry
+
+func (it *sliceIter) next() (entry, bool, error) {
+	if len(*it) == 0 {
+		return entry{}, false, nil
+	}
+	e := (*it)[0]
+	*it = (*it)[1:]
+	return e, true, nil
+}
+
+// mergeIter merges iterators given newest first. Of the records with the same key only
+// the newest one is returned.
+type mergeIter struct {
+	sources []*mergeSource
+}
+
+type mergeSource struct {
+	it  entryIterator
+	cur entry
+	ok  bool
+}
+
+func newMergeIter(its []entryIterator) (*mergeIter, error) {
+	m := &mergeIter{}
+	for _, it := range its {
+		s := &mergeSource{it: it}
+		if err := s.advance(); err != nil {
+			return nil, err
+		}
+		m.sources = append(m.sources, s)
+	}
+	return m, nil
+}
+
+func (s *mergeSource) advance() (err error) {
+	s.cur, s.ok, err = s.it.next()
+	return err
+}
+
+func (m *mergeIter) next() (entry, bool, error) {
+	var min *mergeSource
+	for _, s := range m.sources {
+		if s.ok && (min == nil || s.cur.key < min.cur.key) {
+			min = s
+		}
+	}
+	if min == nil {
+		return entry{}, false, nil
+	}
+	res := min.cur
+	for _, s := range m.sources {
+		for s.ok && s.cur.key == res.key {
+			if err := s.advance(); err != nil {
+				return entry{}, false, err
+			}
+		}
+	}
+	return res, true, nil
+}
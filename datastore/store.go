@@ -0,0 +1,20 @@
+package datastore
+
+// Store is a key-value storage engine. Db appends records to a log with hash indexes in
+// memory; LSM keeps them in tables sorted by key.
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	// Delete returns ErrNotFound if the key has no value.
+	Delete(key string) error
+	// Scan returns the records whose keys start with prefix, sorted by key.
+	Scan(prefix string) ([]KeyValue, error)
+	// Write applies all operations of the batch atomically.
+	Write(b *WriteBatch) error
+	Close()
+}
+
+var (
+	_ Store = (*Db)(nil)
+	_ Store = (*LSM)(nil)
+)
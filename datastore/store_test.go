@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// engines open every storage engine in dir with segments or memtables of size bytes,
+// so that the tests of Store run against all of them.
+var engines = []struct {
+	name string
+	open func(dir string, size int64, opts ...Option) (Store, error)
+}{
+	{"log", func(dir string, size int64, opts ...Option) (Store, error) { return NewDb(dir, size, opts...) }},
+	{"lsm", func(dir string, size int64, opts ...Option) (Store, error) {
+		return NewLSM(dir, append(opts, WithMemtableSize(size))...)
+	}},
+}
+
+// forEngines runs test against every engine opened in a new temporary directory.
+func forEngines(t *testing.T, test func(t *testing.T, open func(size int64, opts ...Option) Store)) {
+	for _, engine := range engines {
+		t.Run(engine.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-store")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			test(t, func(size int64, opts ...Option) Store {
+				s, err := engine.open(dir, size, opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			})
+		})
+	}
+}
+
+func TestReopen(t *testing.T) {
+	forEngines(t, func(t *testing.T, open func(size int64, opts ...Option) Store) {
+		s := open(200)
+		expected := make(map[string]string)
+		for i := 0; i < 300; i++ {
+			key, value := fmt.Sprintf("key%03d", i%50), fmt.Sprintf("value%d", i)
+			if err := s.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+		for i := 0; i < 50; i += 7 {
+			key := fmt.Sprintf("key%03d", i)
+			if err := s.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(expected, key)
+		}
+		s.Close()
+
+		s = open(200)
+		defer s.Close()
+		all, err := s.Scan("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[string]string)
+		for _, kv := range all {
+			res[kv.Key] = kv.Value
+		}
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("Reopened store has %v, want %v", res, expected)
+		}
+		for key, value := range expected {
+			if res, err := s.Get(key); err != nil || res != value {
+				t.Errorf("Got %q, %v for %s, want %q", res, err, key, value)
+			}
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import "fmt"
+
+// ErrConflict is returned by Tx.Commit when a key the transaction read has been written
+// since it began.
+var ErrConflict = fmt.Errorf("transaction conflicts with a concurrent write")
+
+// ErrTxDone is returned by a transaction that was committed or rolled back.
+var ErrTxDone = fmt.Errorf("transaction has already been committed or rolled back")
+
+// Tx reads from a snapshot and buffers its writes until Commit, which applies them with
+// a single append only if none of the keys read has a newer record than the snapshot.
+// A Tx is not safe for concurrent use.
+type Tx struct {
+	snapshot *Snapshot
+	reads    map[string]bool
+	writes   map[string]int
+	entries  []entry
+	done     bool
+}
+
+// Begin starts a transaction. It must be committed or rolled back.
+func (db *Db) Begin() *Tx {
+	return &Tx{
+		snapshot: db.NewSnapshot(),
+		reads:    make(map[string]bool),
+		writes:   make(map[string]int),
+	}
+}
+
+// Get returns the value the transaction wrote to key, or the value as of its start.
+func (tx *Tx) Get(key string) (string, error) {
+	if tx.done {
+		return "", ErrTxDone
+	}
+	if i, ok := tx.writes[key]; ok {
+		if tx.entries[i].deleted {
+			return "", ErrNotFound
+		}
+		return tx.entries[i].value, nil
+	}
+	tx.reads[key] = true
+	return tx.snapshot.Get(key)
+}
+
+func (tx *Tx) Put(key, value string) {
+	tx.write(entry{key: key, value: value})
+}
+
+// Delete removes the key on commit; like in a WriteBatch, the key may not exist.
+func (tx *Tx) Delete(key string) {
+	tx.write(entry{key: key, deleted: true})
+}
+
+func (tx *Tx) write(e entry) {
+	if i, ok := tx.writes[e.key]; ok {
+		tx.entries[i] = e
+		return
+	}
+	tx.writes[e.key] = len(tx.entries)
+	tx.entries = append(tx.entries, e)
+}
+
+// Commit applies the writes atomically, or returns ErrConflict and applies none.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	defer tx.Rollback()
+
+	db := tx.snapshot.db
+	db.indexMutex.Lock()
+	defer db.indexMutex.Unlock()
+	for key := range tx.reads {
+		if db.latestSeq(key) > tx.snapshot.seq {
+			return ErrConflict
+		}
+	}
+	if len(tx.entries) == 0 {
+		return nil
+	}
+	return db.write(tx.entries...)
+}
+
+// Rollback drops the writes. It may be called after Commit.
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.snapshot.Release()
+}
+
+// latestSeq returns the sequence number of the newest record of key, or 0 if it has
+// none. It is called with the index lock held.
+func (db *Db) latestSeq(key string) uint64 {
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		if pos, ok := db.segments[i].lookup(key); ok {
+			return pos.seq
+		}
+	}
+	return 0
+}
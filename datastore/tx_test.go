@@ -0,0 +1,65 @@
+package datastore
+
+import "testing"
+
+func TestTx(t *testing.T) {
+	db := newTestDb(t, 1<<20)
+	if err := db.Put("balance/a", "10"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	if value, err := tx.Get("balance/a"); err != nil || value != "10" {
+		t.Fatalf("Unexpected value %q, %v", value, err)
+	}
+	if _, err := tx.Get("balance/b"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	tx.Put("balance/a", "5")
+	tx.Put("balance/b", "5")
+	if value, err := tx.Get("balance/b"); err != nil || value != "5" {
+		t.Errorf("Expected to read the own write, got %q, %v", value, err)
+	}
+	if _, err := db.Get("balance/b"); err != ErrNotFound {
+		t.Errorf("Expected writes to wait for the commit, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("balance/b"); err != nil || value != "5" {
+		t.Errorf("Unexpected committed value %q, %v", value, err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+
+	// A concurrent write to a key read, even a missing one, fails the commit.
+	for _, key := range []string{"balance/a", "balance/c"} {
+		tx = db.Begin()
+		tx.Get(key)
+		tx.Delete("balance/b")
+		if err := db.Put(key, "100"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != ErrConflict {
+			t.Errorf("Expected ErrConflict after a write to %s, got %v", key, err)
+		}
+		if value, err := db.Get("balance/b"); err != nil || value != "5" {
+			t.Errorf("Expected the conflicting transaction to write nothing, got %q, %v", value, err)
+		}
+	}
+
+	// Writes to keys that were not read do not conflict.
+	tx = db.Begin()
+	tx.Get("balance/a")
+	tx.Put("balance/c", "1")
+	if err := db.Put("balance/c", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(db.snapshots) != 0 {
+		t.Errorf("Expected finished transactions to release their snapshots, got %v", db.snapshots)
+	}
+}
@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrLagging ends a subscription whose events were not read fast enough. The subscriber
+// has missed changes and must read what it needs again.
+var ErrLagging = fmt.Errorf("subscriber fell behind the writes")
+
+// subscriptionBuffer is the number of events a subscriber may fall behind by.
+const subscriptionBuffer = 256
+
+// Event is a committed put or delete. The writes of a batch share a sequence number.
+type Event struct {
+	Seq     uint64 `json:"seq"`
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Subscription delivers the events of keys with a prefix in the order of their commits.
+type Subscription struct {
+	prefix string
+	events chan Event
+	w      *watchers
+	err    error
+}
+
+// watchers are the live subscriptions of a db.
+type watchers struct {
+	mutex sync.Mutex
+	subs  map[*Subscription]bool
+}
+
+// Subscribe returns the events of the writes committed from now on to keys that start
+// with prefix. The subscription must be closed.
+func (db *Db) Subscribe(prefix string) *Subscription {
+	s := &Subscription{prefix: prefix, events: make(chan Event, subscriptionBuffer), w: &db.watchers}
+	db.watchers.mutex.Lock()
+	defer db.watchers.mutex.Unlock()
+	if db.watchers.subs == nil {
+		db.watchers.subs = make(map[*Subscription]bool)
+	}
+	db.watchers.subs[s] = true
+	return s
+}
+
+// Events is closed when the subscription ends; Err tells why.
+func (s *Subscription) Events() <-chan Event { return s.events }
+
+// Err returns ErrLagging if the subscription ended because events were not read in time.
+func (s *Subscription) Err() error {
+	s.w.mutex.Lock()
+	defer s.w.mutex.Unlock()
+	return s.err
+}
+
+func (s *Subscription) Close() {
+	s.w.mutex.Lock()
+	defer s.w.mutex.Unlock()
+	s.end(nil)
+}
+
+// end is called with the mutex of the watchers held.
+func (s *Subscription) end(err error) {
+	if !s.w.subs[s] {
+		return
+	}
+	delete(s.w.subs, s)
+	s.err = err
+	close(s.events)
+}
+
+// notify passes the committed entries on without blocking the writer: a subscriber that
+// has no room for an event is dropped with ErrLagging.
+func (w *watchers) notify(entries []entry, seq uint64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for s := range w.subs {
+		for _, e := range entries {
+			if !strings.HasPrefix(e.key, s.prefix) {
+				continue
+			}
+			select {
+			case s.events <- Event{Seq: seq, Key: e.key, Value: e.value, Deleted: e.deleted}:
+			default:
+				s.end(ErrLagging)
+			}
+			if !s.w.subs[s] {
+				break
+			}
+		}
+	}
+}
+
+func (w *watchers) closeAll() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for s := range w.subs {
+		s.end(nil)
+	}
+}
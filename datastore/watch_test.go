@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	db := newTestDb(t, 1<<20)
+
+	users := db.Subscribe("user/")
+	defer users.Close()
+	lagging := db.Subscribe("")
+
+	if err := db.Put("order/1", "o"); err != nil {
+		t.Fatal(err)
+	}
+	b := new(WriteBatch)
+	b.Put("user/1", "a")
+	b.Delete("user/2")
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{{Seq: 2, Key: "user/1", Value: "a"}, {Seq: 2, Key: "user/2", Deleted: true}}
+	for _, want := range expected {
+		if got := <-users.Events(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Got event %+v, want %+v", got, want)
+		}
+	}
+	select {
+	case e := <-users.Events():
+		t.Errorf("Unexpected event %+v", e)
+	default:
+	}
+
+	// The unread subscription is dropped rather than blocking writes.
+	for i := 0; i < subscriptionBuffer; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	for range lagging.Events() {
+		n++
+	}
+	if n != subscriptionBuffer || lagging.Err() != ErrLagging {
+		t.Errorf("Expected ErrLagging after %d events, got %v after %d", subscriptionBuffer, lagging.Err(), n)
+	}
+
+	users.Close()
+	if _, ok := <-users.Events(); ok || users.Err() != nil {
+		t.Errorf("Expected a closed subscription to end without an error, got %v", users.Err())
+	}
+}
@@ -0,0 +1,40 @@
+package dbclient
+
+type batchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Batch collects operations for Client.Batch, mirroring datastore.WriteBatch.
+type Batch struct {
+	ops []batchOp
+}
+
+func (b *Batch) Put(key, value string) {
+	b.ops = append(b.ops, batchOp{Op: "put", Key: key, Value: value})
+}
+
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{Op: "delete", Key: key})
+}
+
+func (b *Batch) Len() int { return len(b.ops) }
+
+// Condition is a check of Client.Txn on the value of a key.
+type Condition struct {
+	Key    string  `json:"key"`
+	Value  *string `json:"value,omitempty"`
+	Exists *bool   `json:"exists,omitempty"`
+}
+
+// ValueIs holds if key has the value.
+func ValueIs(key, value string) Condition {
+	return Condition{Key: key, Value: &value}
+}
+
+// Missing holds if key has no value.
+func Missing(key string) Condition {
+	exists := false
+	return Condition{Key: key, Exists: &exists}
+}
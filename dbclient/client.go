@@ -0,0 +1,285 @@
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+var (
+	// ErrNotFound is the datastore error itself, so errors.Is works the same on both sides of the API.
+	ErrNotFound    = datastore.ErrNotFound
+	ErrConflict    = datastore.ErrConflict
+	ErrBadRequest  = errors.New("bad request")
+	ErrUnavailable = errors.New("db is unavailable")
+	// ErrNotImplemented is returned for a feature the storage engine of the db lacks.
+	ErrNotImplemented = errors.New("not supported by the db")
+)
+
+// StatusError describes an unsuccessful response of the db API. It unwraps to
+// ErrNotFound, ErrConflict, ErrBadRequest, ErrNotImplemented or ErrUnavailable depending
+// on the status code.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("db responded with %d %s", e.Code, http.StatusText(e.Code))
+	}
+	return fmt.Sprintf("db responded with %d: %s", e.Code, e.Message)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.Code == http.StatusNotFound:
+		return ErrNotFound
+	case e.Code == http.StatusConflict:
+		return ErrConflict
+	case e.Code == http.StatusNotImplemented:
+		return ErrNotImplemented
+	case e.Code >= http.StatusInternalServerError:
+		return ErrUnavailable
+	default:
+		return ErrBadRequest
+	}
+}
+
+type KeyValue = datastore.KeyValue
+
+type Client struct {
+	baseURL    string
+	http       *http.Client
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the pooled HTTP client, e.g. to wrap its transport.
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) { client.http = c }
+}
+
+// WithRetries sets how many times a request is retried after a transport error or an
+// unavailable db, and the initial delay that doubles on every attempt.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(client *Client) {
+		client.retries = retries
+		client.backoff = backoff
+	}
+}
+
+// NewTransport returns the pooled transport used by default, for callers that wrap it.
+func NewTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 100
+	t.MaxIdleConnsPerHost = 32
+	t.IdleConnTimeout = 90 * time.Second
+	return t
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		http:       &http.Client{Transport: NewTransport(), Timeout: 10 * time.Second},
+		retries:    3,
+		backoff:    100 * time.Millisecond,
+		maxBackoff: 2 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Client) BaseURL() string { return c.baseURL }
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var res KeyValue
+	if err := c.do(ctx, http.MethodGet, keyPath(key), nil, &res); err != nil {
+		return "", err
+	}
+	return res.Value, nil
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.do(ctx, http.MethodPut, keyPath(key), map[string]string{"value": value}, nil)
+}
+
+// Delete removes the key. A delete that is retried after an ambiguous failure and then
+// finds no key is reported as successful.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, keyPath(key), nil, nil)
+}
+
+// Scan returns the records whose keys start with prefix, sorted by key. A positive limit
+// caps the number of returned records.
+func (c *Client) Scan(ctx context.Context, prefix string, limit int) ([]KeyValue, error) {
+	return c.ScanAfter(ctx, prefix, "", limit)
+}
+
+// ScanAfter is Scan for the keys after the key after, to read a large prefix in pages
+// of limit records.
+func (c *Client) ScanAfter(ctx context.Context, prefix, after string, limit int) ([]KeyValue, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	if after != "" {
+		query.Set("after", after)
+	}
+	if limit > 0 {
+		query.Set("limit", fmt.Sprint(limit))
+	}
+
+	var res struct {
+		Items []KeyValue `json:"items"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/db/_scan?"+query.Encode(), nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Items, nil
+}
+
+// Batch applies all operations of b atomically.
+func (c *Client) Batch(ctx context.Context, b *Batch) error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	return c.do(ctx, http.MethodPost, "/db/_batch", b.ops, nil)
+}
+
+// Txn applies the operations of b atomically if all conditions hold at the same time.
+// Otherwise nothing is written and the error unwraps to ErrConflict. Unlike other
+// requests, a transaction is retried only if it never reached the db: a retry of one
+// that was applied before its response got lost would fail its own conditions.
+func (c *Client) Txn(ctx context.Context, conditions []Condition, b *Batch) error {
+	body := struct {
+		Conditions []Condition `json:"conditions"`
+		Operations []batchOp   `json:"operations"`
+	}{conditions, b.ops}
+	return c.send(ctx, http.MethodPost, "/db/_txn", body, nil, unsent)
+}
+
+func keyPath(key string) string {
+	return "/db/" + url.PathEscape(key)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	return c.send(ctx, method, path, body, out, retryable)
+}
+
+// send makes the request, retrying it after the errors that retry accepts.
+func (c *Client) send(ctx context.Context, method, path string, body, out interface{}, retry func(error) bool) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, path, data, out)
+		if attempt > 0 && method == http.MethodDelete && errors.Is(err, ErrNotFound) {
+			// The failed attempt may have deleted the key already.
+			return nil
+		}
+		if err == nil || !retry(err) || attempt >= c.retries {
+			return err
+		}
+		if c.wait(ctx, attempt) != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, data []byte, out interface{}) error {
+	var reader io.Reader
+	if data != nil {
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection goes back to the pool.
+	defer io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return &StatusError{Code: resp.StatusCode, Message: body.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("malformed db response: %w", err)
+	}
+	return nil
+}
+
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.Code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// unsent reports whether the request failed before it reached the db, so that retrying
+// it cannot apply it twice.
+func unsent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	delay := c.backoff << attempt
+	if delay > c.maxBackoff || delay <= 0 {
+		delay = c.maxBackoff
+	}
+	// Full jitter keeps retrying clients from hitting the db in lockstep.
+	delay = time.Duration(rand.Int63n(int64(delay) + 1))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,302 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbserver"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "test-dbclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(dbserver.NewHandler(db, nil))
+	t.Cleanup(func() {
+		srv.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	srv := newTestServer(t)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) || !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if err := c.Put(ctx, "key with spaces", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "key with spaces"); err != nil || value != "value1" {
+		t.Errorf("Unexpected get result %q, %v", value, err)
+	}
+
+	if err := c.Delete(ctx, "key with spaces"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "key with spaces"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+	}
+
+	b := new(Batch)
+	b.Put("user/1", "a")
+	b.Put("user/2", "b")
+	b.Put("user/3", "c")
+	b.Put("order/1", "o")
+	b.Delete("user/3")
+	if err := c.Batch(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := c.Scan(ctx, "user/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []KeyValue{{Key: "user/1", Value: "a"}, {Key: "user/2", Value: "b"}}; !reflect.DeepEqual(items, expected) {
+		t.Errorf("Unexpected scan result %v", items)
+	}
+	if items, err := c.Scan(ctx, "", 1); err != nil || len(items) != 1 || items[0].Key != "order/1" {
+		t.Errorf("Unexpected limited scan result %v, %v", items, err)
+	}
+
+	bad := new(Batch)
+	bad.Put("", "no key")
+	var statusErr *StatusError
+	if err := c.Batch(ctx, bad); !errors.Is(err, ErrBadRequest) || !errors.As(err, &statusErr) || statusErr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad request error, got %v", err)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	srv := newTestServer(t)
+
+	var failures atomic.Int32
+	failures.Store(2)
+	flaky := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.URL.Scheme, r.URL.Host, r.RequestURI = "http", srv.Listener.Addr().String(), ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		rw.WriteHeader(resp.StatusCode)
+	}))
+	defer flaky.Close()
+
+	ctx := context.Background()
+	c := New(flaky.URL, WithRetries(3, time.Millisecond))
+	if err := c.Put(ctx, "key", "value"); err != nil {
+		t.Fatalf("Expected the put to succeed after retries, got %v", err)
+	}
+
+	failures.Store(5)
+	if err := c.Put(ctx, "key", "value"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable once retries are exhausted, got %v", err)
+	}
+
+	// A delete whose first attempt failed ambiguously succeeds if the key is gone on retry.
+	failures.Store(1)
+	if err := c.Delete(ctx, "missing"); err != nil {
+		t.Errorf("Expected a retried delete of a missing key to succeed, got %v", err)
+	}
+
+	unreachable := New("http://127.0.0.1:1", WithRetries(10, time.Hour))
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := unreachable.Put(cancelled, "key", "value"); err == nil {
+		t.Error("Expected an error from an unreachable db")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Retries did not stop when the context was cancelled")
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	srv := newTestServer(t)
+	c := New(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ready := make(chan struct{})
+	events := make(chan Event, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Watch(ctx, "user/", func() { close(ready) }, func(e Event) { events <- e })
+	}()
+	<-ready
+
+	for _, key := range []string{"order/1", "user/1"} {
+		if err := c.Put(ctx, key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Delete(ctx, "user/1"); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Key != "user/1" || e.Value != "value" || e.Deleted {
+		t.Errorf("Unexpected put event %+v", e)
+	}
+	if e := <-events; e.Key != "user/1" || !e.Deleted {
+		t.Errorf("Unexpected delete event %+v", e)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the watch to end with the context, got %v", err)
+	}
+}
+
+func TestClient_Txn(t *testing.T) {
+	srv := newTestServer(t)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	b := new(Batch)
+	b.Put("lock", "owner1")
+	if err := c.Txn(ctx, []Condition{Missing("lock")}, b); err != nil {
+		t.Fatal(err)
+	}
+	b = new(Batch)
+	b.Put("lock", "owner2")
+	if err := c.Txn(ctx, []Condition{Missing("lock")}, b); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict taking a held lock, got %v", err)
+	}
+
+	b = new(Batch)
+	b.Delete("lock")
+	b.Put("released", "owner1")
+	if err := c.Txn(ctx, []Condition{ValueIs("lock", "owner1")}, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "lock"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the lock to be released, got %v", err)
+	}
+	if value, err := c.Get(ctx, "released"); err != nil || value != "owner1" {
+		t.Errorf("Unexpected value %q, %v", value, err)
+	}
+}
+
+func TestClient_TxnLostResponse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-dbclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The transaction is committed, but the connection drops before the response.
+	var attempts atomic.Int32
+	h := dbserver.NewHandler(db, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/db/_txn" {
+			h.ServeHTTP(rw, r)
+			return
+		}
+		attempts.Add(1)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		conn, _, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer srv.Close()
+	c := New(srv.URL, WithRetries(3, time.Millisecond))
+	ctx := context.Background()
+
+	b := new(Batch)
+	b.Put("lock", "owner1")
+	err = c.Txn(ctx, []Condition{Missing("lock")}, b)
+	if err == nil || errors.Is(err, ErrConflict) {
+		t.Errorf("Expected a transport error, got %v", err)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("Expected the transaction to be sent once, got %d attempts", n)
+	}
+	if value, err := c.Get(ctx, "lock"); err != nil || value != "owner1" {
+		t.Errorf("Unexpected value %q, %v", value, err)
+	}
+}
+
+func TestClient_Limits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-dbclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 1024, datastore.WithSizeLimits(8, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := httptest.NewServer(dbserver.NewHandler(db, nil, dbserver.WithLimits(8, 64)))
+	defer srv.Close()
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	// Slashes are escaped, so such keys are a single path segment.
+	if err := c.Put(ctx, "user/1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "user/1"); err != nil || value != "a" {
+		t.Errorf("Unexpected get result %q, %v", value, err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		key, value string
+		code       int
+	}{
+		{"long key", "too-long-key", "a", http.StatusBadRequest},
+		{"large value", "key", "value over the limit", http.StatusRequestEntityTooLarge},
+		{"large body", "key", strings.Repeat("b", 100), http.StatusRequestEntityTooLarge},
+	} {
+		var statusErr *StatusError
+		if err := c.Put(ctx, tc.key, tc.value); !errors.As(err, &statusErr) || statusErr.Code != tc.code {
+			t.Errorf("%s: expected status %d, got %v", tc.name, tc.code, err)
+		}
+	}
+
+	for _, path := range []string{"/db/", "/db/user/1"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Got %d for %s, want 400", resp.StatusCode, path)
+		}
+	}
+}
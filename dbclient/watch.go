@@ -0,0 +1,78 @@
+package dbclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+// ErrWatchEnded is returned by Watch when the db closes the stream.
+var ErrWatchEnded = errors.New("db closed the watch stream")
+
+type Event = datastore.Event
+
+// Watch calls fn with the changes of keys that start with prefix until ctx is done or
+// the stream breaks, and returns why. Changes made while no stream is open are missed,
+// so callers should resynchronize in ready, which is called once the db streams changes.
+// A db that drops a slow watcher makes Watch return datastore.ErrLagging.
+func (c *Client) Watch(ctx context.Context, prefix string, ready func(), fn func(Event)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/db/_watch?"+url.Values{"prefix": {prefix}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The stream outlives the request timeout of c.http.
+	resp, err := (&http.Client{Transport: c.http.Transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return &StatusError{Code: resp.StatusCode, Message: body.Error}
+	}
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "":
+			switch event {
+			case "ready":
+				ready()
+			case "put", "delete":
+				var e Event
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					return fmt.Errorf("malformed watch event: %w", err)
+				}
+				fn(e)
+			case "overflow":
+				return datastore.ErrLagging
+			}
+			event, data = "", ""
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ErrWatchEnded
+}
@@ -0,0 +1,515 @@
+package dbserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+	"github.com/KPI-3-Architecture-Labs/lab4/tracing"
+)
+
+// BatchOp is a single operation of a POST /db/_batch request.
+type BatchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// TxCondition is a check of a POST /db/_txn request: the key must have Value, or no
+// value if Exists is false.
+type TxCondition struct {
+	Key    string  `json:"key"`
+	Value  *string `json:"value,omitempty"`
+	Exists *bool   `json:"exists,omitempty"`
+}
+
+// TxRequest is the body of POST /db/_txn. The operations are applied atomically if
+// all conditions hold.
+type TxRequest struct {
+	Conditions []TxCondition `json:"conditions"`
+	Operations []BatchOp     `json:"operations"`
+}
+
+type ScanResponse struct {
+	Items []datastore.KeyValue `json:"items"`
+}
+
+// snapshotter and compacter are the admin features of datastore.Db that other engines
+// may lack.
+type snapshotter interface {
+	Snapshot(w io.Writer) error
+}
+
+type compacter interface {
+	Compact() error
+	Segments() []datastore.SegmentInfo
+}
+
+type subscriber interface {
+	Subscribe(prefix string) *datastore.Subscription
+}
+
+type transactor interface {
+	Begin() *datastore.Tx
+}
+
+// txRetries is how many times a transaction whose conditions hold is retried after
+// losing to a concurrent write.
+const txRetries = 3
+
+// watchKeepAlive is how often an idle watch stream gets a comment, so that proxies
+// keep the connection open.
+const watchKeepAlive = 15 * time.Second
+
+type handler struct {
+	db       datastore.Store
+	tracer   *tracing.Tracer
+	readOnly func() bool
+	limits   Limits
+}
+
+type Option func(*handler)
+
+// WithReadOnly rejects writes with 403 Forbidden while readOnly returns true, e.g. on
+// a replication follower.
+func WithReadOnly(readOnly func() bool) Option {
+	return func(h *handler) { h.readOnly = readOnly }
+}
+
+// WithLimits rejects keys longer than maxKeySize bytes with 400 Bad Request and request
+// bodies over maxBodySize bytes with 413 instead of the DefaultLimits. Values are
+// limited by the datastore.
+func WithLimits(maxKeySize int, maxBodySize int64) Option {
+	return func(h *handler) { h.limits = Limits{MaxKeySize: maxKeySize, MaxBodySize: maxBodySize} }
+}
+
+// NewHandler serves the cmd/db HTTP API for db under /db/. Datastore calls are recorded
+// as child spans of the request span when tracer is not nil.
+func NewHandler(db datastore.Store, tracer *tracing.Tracer, opts ...Option) http.Handler {
+	if tracer == nil {
+		tracer = tracing.NewTracer("db", nil)
+	}
+	h := &handler{
+		db:       db,
+		tracer:   tracer,
+		readOnly: func() bool { return false },
+		limits:   DefaultLimits,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db/", h.serveKey)
+	mux.HandleFunc("/db/_scan", h.serveScan)
+	mux.HandleFunc("/db/_batch", h.serveBatch)
+	mux.HandleFunc("/db/_watch", h.serveWatch)
+	mux.HandleFunc("/db/_txn", h.serveTxn)
+	mux.HandleFunc("/admin/backup", h.serveBackup)
+	mux.HandleFunc("/admin/compact", h.serveCompact)
+	return mux
+}
+
+func writeError(rw http.ResponseWriter, status int, message string) {
+	rw.Header().Set("Content-Type", contentJSON)
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(map[string]string{"error": message})
+}
+
+// allowMethods responds with 405 Method Not Allowed and returns false unless the method
+// of req is one of methods.
+func allowMethods(rw http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	rw.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+	return false
+}
+
+// writeFailure responds to a failed write: 400 or 413 for a key or value over the
+// limits of the datastore, 500 otherwise.
+func writeFailure(rw http.ResponseWriter, err error) {
+	var sizeErr *datastore.SizeError
+	switch {
+	case errors.As(err, &sizeErr) && sizeErr.Field == "key":
+		writeError(rw, http.StatusBadRequest, "Key is too long")
+	case errors.As(err, &sizeErr):
+		writeError(rw, http.StatusRequestEntityTooLarge, "Value is too large")
+	default:
+		writeError(rw, http.StatusInternalServerError, "Internal Server Error")
+	}
+}
+
+// rejectWrite responds with 403 Forbidden if the handler is read-only.
+func (h *handler) rejectWrite(rw http.ResponseWriter) bool {
+	if !h.readOnly() {
+		return false
+	}
+	writeError(rw, http.StatusForbidden, "Read-only replica")
+	return true
+}
+
+// serveKey serves a single key. GET and HEAD respond with the value as JSON or, if the
+// Accept header prefers it, as text/plain. PUT upserts the value and POST does the same
+// for older clients; both take a JSON body with the value field or a text/plain value.
+func (h *handler) serveKey(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	key, ok := h.limits.Key(rw, req)
+	if !ok {
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && h.rejectWrite(rw) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		contentType, ok := AcceptValue(rw, req)
+		if !ok {
+			return
+		}
+
+		_, span := h.tracer.Start(req.Context(), "datastore.Get", tracing.SpanKindInternal)
+		span.SetAttribute("db.key", key)
+		value, err := h.db.Get(key)
+		span.SetError(err)
+		span.End()
+		if err == datastore.ErrNotFound {
+			writeError(rw, http.StatusNotFound, "Not found")
+			return
+		}
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		WriteValue(rw, req, contentType, key, value)
+
+	case http.MethodPut, http.MethodPost:
+		value, ok := h.limits.ReadValue(rw, req)
+		if !ok {
+			return
+		}
+
+		_, span := h.tracer.Start(req.Context(), "datastore.Put", tracing.SpanKindInternal)
+		span.SetAttribute("db.key", key)
+		err := h.db.Put(key, value)
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			writeFailure(rw, err)
+			return
+		}
+		if req.Method == http.MethodPut {
+			rw.WriteHeader(http.StatusNoContent)
+		} else {
+			rw.WriteHeader(http.StatusCreated)
+		}
+
+	case http.MethodDelete:
+		_, span := h.tracer.Start(req.Context(), "datastore.Delete", tracing.SpanKindInternal)
+		span.SetAttribute("db.key", key)
+		err := h.db.Delete(key)
+		span.SetError(err)
+		span.End()
+		if err == datastore.ErrNotFound {
+			writeError(rw, http.StatusNotFound, "Not found")
+			return
+		}
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveScan lists the records whose keys start with the prefix parameter, sorted by
+// key. Only keys after the after parameter are listed, so that with limit a large
+// range can be read page by page.
+func (h *handler) serveScan(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet) {
+		return
+	}
+
+	prefix, after := req.URL.Query().Get("prefix"), req.URL.Query().Get("after")
+	limit := 0
+	if l := req.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			writeError(rw, http.StatusBadRequest, "Bad limit")
+			return
+		}
+		limit = n
+	}
+
+	_, span := h.tracer.Start(req.Context(), "datastore.Scan", tracing.SpanKindInternal)
+	span.SetAttribute("db.prefix", prefix)
+	items, err := h.db.Scan(prefix)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if after != "" {
+		items = items[sort.Search(len(items), func(i int) bool { return items[i].Key > after }):]
+	}
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	if items == nil {
+		items = []datastore.KeyValue{}
+	}
+
+	rw.Header().Set("Content-Type", contentJSON)
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(ScanResponse{Items: items})
+}
+
+func (h *handler) serveBatch(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodPost) {
+		return
+	}
+
+	if h.rejectWrite(rw) {
+		return
+	}
+
+	var ops []BatchOp
+	if !h.limits.DecodeBody(rw, req, &ops) {
+		return
+	}
+
+	b := new(datastore.WriteBatch)
+	if message := h.addOps(b, ops); message != "" {
+		writeError(rw, http.StatusBadRequest, message)
+		return
+	}
+
+	_, span := h.tracer.Start(req.Context(), "datastore.Write", tracing.SpanKindInternal)
+	span.SetAttribute("db.batch_size", b.Len())
+	err := h.db.Write(b)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		writeFailure(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// writer is what batch operations are added to: a datastore.WriteBatch or Tx.
+type writer interface {
+	Put(key, value string)
+	Delete(key string)
+}
+
+// addOps adds the operations to w, returning a message for the client if one is invalid.
+func (h *handler) addOps(w writer, ops []BatchOp) string {
+	for _, op := range ops {
+		if message := h.limits.CheckKey(op.Key); message != "" {
+			return message
+		}
+		switch {
+		case op.Op == "put":
+			w.Put(op.Key, op.Value)
+		case op.Op == "delete":
+			w.Delete(op.Key)
+		default:
+			return "Unknown operation " + strconv.Quote(op.Op)
+		}
+	}
+	return ""
+}
+
+// serveTxn applies the operations of a TxRequest if all of its conditions hold. A failed
+// condition is reported with 409 Conflict and nothing is written.
+func (h *handler) serveTxn(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodPost) {
+		return
+	}
+	if h.rejectWrite(rw) {
+		return
+	}
+
+	db, ok := h.db.(transactor)
+	if !ok {
+		writeError(rw, http.StatusNotImplemented, "Transactions are not supported by the storage engine")
+		return
+	}
+
+	var body TxRequest
+	if !h.limits.DecodeBody(rw, req, &body) {
+		return
+	}
+	for _, c := range body.Conditions {
+		if message := h.limits.CheckKey(c.Key); message != "" {
+			writeError(rw, http.StatusBadRequest, message)
+			return
+		}
+	}
+
+	_, span := h.tracer.Start(req.Context(), "datastore.Tx", tracing.SpanKindInternal)
+	span.SetAttribute("db.batch_size", len(body.Operations))
+	defer span.End()
+	for attempt := 0; ; attempt++ {
+		status, message, err := h.runTxn(db.Begin(), body)
+		if err == datastore.ErrConflict && attempt < txRetries {
+			continue
+		}
+		span.SetError(err)
+		switch {
+		case err == datastore.ErrConflict:
+			writeError(rw, http.StatusConflict, "Conflicting concurrent writes")
+		case err != nil:
+			writeFailure(rw, err)
+		case message != "":
+			writeError(rw, status, message)
+		default:
+			rw.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+}
+
+// runTxn checks the conditions of body and commits its operations with tx. A status and
+// message are returned for a request that fails without an error of the db.
+func (h *handler) runTxn(tx *datastore.Tx, body TxRequest) (int, string, error) {
+	defer tx.Rollback()
+	for _, c := range body.Conditions {
+		value, err := tx.Get(c.Key)
+		if err != nil && err != datastore.ErrNotFound {
+			return 0, "", err
+		}
+		exists := err == nil
+		if c.Exists != nil && *c.Exists != exists || c.Value != nil && (!exists || value != *c.Value) {
+			return http.StatusConflict, "Condition failed for key " + strconv.Quote(c.Key), nil
+		}
+	}
+	if message := h.addOps(tx, body.Operations); message != "" {
+		return http.StatusBadRequest, message, nil
+	}
+	return 0, "", tx.Commit()
+}
+
+// serveBackup streams a snapshot of the db that datastore.Restore can unpack.
+func (h *handler) serveBackup(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet) {
+		return
+	}
+
+	db, ok := h.db.(snapshotter)
+	if !ok {
+		writeError(rw, http.StatusNotImplemented, "Backups are not supported by the storage engine")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-tar")
+	rw.Header().Set("Content-Disposition", `attachment; filename="db-backup.tar"`)
+	_, span := h.tracer.Start(req.Context(), "datastore.Snapshot", tracing.SpanKindInternal)
+	err := db.Snapshot(rw)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		// The status is sent already, so a broken archive is all the client gets.
+		log.Printf("Failed to stream a backup: %s", err)
+	}
+}
+
+// serveCompact merges all sealed segments and responds with the resulting segments.
+func (h *handler) serveCompact(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodPost) {
+		return
+	}
+
+	db, ok := h.db.(compacter)
+	if !ok {
+		writeError(rw, http.StatusNotImplemented, "Manual compaction is not supported by the storage engine")
+		return
+	}
+
+	_, span := h.tracer.Start(req.Context(), "datastore.Compact", tracing.SpanKindInternal)
+	err := db.Compact()
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	rw.Header().Set("Content-Type", contentJSON)
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(map[string][]datastore.SegmentInfo{"segments": db.Segments()})
+}
+
+// serveWatch streams the changes of keys that start with the prefix parameter as
+// Server-Sent Events: a ready event once the stream is set up, then a put or delete
+// event per changed key with the sequence number of its write as the event ID. A client
+// that falls behind gets an overflow event and the stream ends. Changes made while a
+// client is not connected are not replayed, so clients resynchronize after ready.
+func (h *handler) serveWatch(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet) {
+		return
+	}
+
+	db, ok := h.db.(subscriber)
+	if !ok {
+		writeError(rw, http.StatusNotImplemented, "Watching is not supported by the storage engine")
+		return
+	}
+	sub := db.Subscribe(req.URL.Query().Get("prefix"))
+	defer sub.Close()
+
+	rc := http.NewResponseController(rw)
+	// The write timeout of the server would cut the stream.
+	rc.SetWriteDeadline(time.Time{})
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprint(rw, "event: ready\ndata: {}\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+		case e, ok := <-sub.Events():
+			if !ok {
+				if sub.Err() != nil {
+					fmt.Fprint(rw, "event: overflow\ndata: {}\n\n")
+					rc.Flush()
+				}
+				return
+			}
+			kind := "put"
+			if e.Deleted {
+				kind = "delete"
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, kind, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package dbserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+func newTestDb(t *testing.T) *datastore.Db {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "test-dbserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return db
+}
+
+func newTestHandler(t *testing.T, opts ...Option) http.Handler {
+	t.Helper()
+	return NewHandler(newTestDb(t), nil, opts...)
+}
+
+func serve(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandler_Key(t *testing.T) {
+	h := newTestHandler(t)
+
+	if rec := serve(h, http.MethodPut, "/db/user%2F1", `{"value": "json"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("PUT responded with %d: %s", rec.Code, rec.Body)
+	}
+	rec := serve(h, http.MethodGet, "/db/user%2F1", "")
+	var kv datastore.KeyValue
+	if err := json.NewDecoder(rec.Body).Decode(&kv); err != nil || kv != (datastore.KeyValue{Key: "user/1", Value: "json"}) {
+		t.Errorf("GET responded with %+v, %v", kv, err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+
+	if rec := serve(h, http.MethodPut, "/db/user%2F1", "plain", "Content-Type", "text/plain"); rec.Code != http.StatusNoContent {
+		t.Fatalf("PUT of text responded with %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(h, http.MethodGet, "/db/user%2F1", "", "Accept", "text/html, text/plain;q=0.9, application/json;q=0.5")
+	if rec.Body.String() != "plain" || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("GET of text responded with %q as %q", rec.Body, rec.Header().Get("Content-Type"))
+	}
+	// The most specific range decides, so text/plain is refused despite */*.
+	rec = serve(h, http.MethodGet, "/db/user%2F1", "", "Accept", "*/*;q=0.5, text/plain;q=0")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON for a refused text/plain, got %q", ct)
+	}
+	rec = serve(h, http.MethodGet, "/db/user%2F1", "", "Accept", "application/*;q=0, text/*;q=0.2, */*")
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Expected text for a refused application/*, got %q", ct)
+	}
+	if rec := serve(h, http.MethodGet, "/db/user%2F1", "", "Accept", "text/html"); rec.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected 406 for an unavailable media type, got %d", rec.Code)
+	}
+
+	// POST still creates values for older clients.
+	if rec := serve(h, http.MethodPost, "/db/key", `{"value": "posted"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("POST responded with %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(h, http.MethodHead, "/db/key", "")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("HEAD responded with %d and %d bytes", rec.Code, rec.Body.Len())
+	}
+	if get := serve(h, http.MethodGet, "/db/key", ""); rec.Header().Get("Content-Length") != get.Header().Get("Content-Length") {
+		t.Errorf("HEAD Content-Length %q differs from GET %q", rec.Header().Get("Content-Length"), get.Header().Get("Content-Length"))
+	}
+
+	if rec := serve(h, http.MethodDelete, "/db/key", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE responded with %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodHead, "/db/key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a deleted key responded with %d", rec.Code)
+	}
+}
+
+func TestHandler_Errors(t *testing.T) {
+	readOnly := false
+	h := newTestHandler(t, WithLimits(8, 80), WithReadOnly(func() bool { return readOnly }))
+
+	for _, tc := range []struct {
+		name, method, target, body string
+		code                       int
+		allow                      string
+	}{
+		{"unknown method", http.MethodPatch, "/db/key", "", http.StatusMethodNotAllowed, "GET, HEAD, PUT, POST, DELETE"},
+		{"scan method", http.MethodPost, "/db/_scan", "", http.StatusMethodNotAllowed, "GET"},
+		{"batch method", http.MethodGet, "/db/_batch", "", http.StatusMethodNotAllowed, "POST"},
+		{"missing key", http.MethodGet, "/db/", "", http.StatusBadRequest, ""},
+		{"nested key", http.MethodGet, "/db/a/b", "", http.StatusBadRequest, ""},
+		{"long key", http.MethodPut, "/db/too-long-key", `{"value": "v"}`, http.StatusBadRequest, ""},
+		{"malformed body", http.MethodPut, "/db/key", `{"value":`, http.StatusBadRequest, ""},
+		{"large body", http.MethodPut, "/db/key", `{"value": "` + strings.Repeat("v", 80) + `"}`, http.StatusRequestEntityTooLarge, ""},
+		{"batch key", http.MethodPost, "/db/_batch", `[{"op": "put", "key": ""}]`, http.StatusBadRequest, ""},
+		{"txn method", http.MethodGet, "/db/_txn", "", http.StatusMethodNotAllowed, "POST"},
+		{"malformed txn", http.MethodPost, "/db/_txn", `{"operations": {}}`, http.StatusBadRequest, ""},
+		{"txn operation", http.MethodPost, "/db/_txn", `{"operations": [{"op": "move", "key": "key"}]}`, http.StatusBadRequest, ""},
+		{"txn condition key", http.MethodPost, "/db/_txn", `{"conditions": [{"key": "", "exists": true}]}`, http.StatusBadRequest, ""},
+		{"txn condition", http.MethodPost, "/db/_txn", `{"conditions": [{"key": "missing", "exists": true}]}`, http.StatusConflict, ""},
+		{"compact method", http.MethodGet, "/admin/compact", "", http.StatusMethodNotAllowed, "POST"},
+		{"backup method", http.MethodPost, "/admin/backup", "", http.StatusMethodNotAllowed, "GET"},
+		{"missing value", http.MethodGet, "/db/missing", "", http.StatusNotFound, ""},
+	} {
+		rec := serve(h, tc.method, tc.target, tc.body)
+		if rec.Code != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.name, rec.Code, tc.code)
+		}
+		if allow := rec.Header().Get("Allow"); allow != tc.allow {
+			t.Errorf("%s: got Allow %q, want %q", tc.name, allow, tc.allow)
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Error == "" || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: expected a JSON error, got %q as %q", tc.name, body.Error, rec.Header().Get("Content-Type"))
+		}
+	}
+
+	readOnly = true
+	if rec := serve(h, http.MethodPut, "/db/key", `{"value": "v"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 from a read-only handler, got %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodHead, "/db/missing", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected reads of a read-only handler, got %d", rec.Code)
+	}
+
+	// The LSM engine has none of the optional features.
+	dir, err := ioutil.TempDir("", "test-dbserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lsm, err := datastore.NewLSM(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	h = NewHandler(lsm, nil)
+	for _, target := range []string{"/db/_txn", "/admin/compact"} {
+		if rec := serve(h, http.MethodPost, target, `{}`); rec.Code != http.StatusNotImplemented {
+			t.Errorf("%s: got %d, want 501", target, rec.Code)
+		}
+	}
+	for _, target := range []string{"/admin/backup", "/db/_watch"} {
+		if rec := serve(h, http.MethodGet, target, ""); rec.Code != http.StatusNotImplemented {
+			t.Errorf("%s: got %d, want 501", target, rec.Code)
+		}
+	}
+}
+
+// racingDb writes to key after each of the next races transactions begins, so that
+// they conflict on commit while their conditions still hold.
+type racingDb struct {
+	*datastore.Db
+	key   string
+	races int
+}
+
+func (db *racingDb) Begin() *datastore.Tx {
+	tx := db.Db.Begin()
+	if db.races > 0 {
+		db.races--
+		value, _ := db.Db.Get(db.key)
+		db.Db.Put(db.key, value)
+	}
+	return tx
+}
+
+func TestHandler_Txn(t *testing.T) {
+	db := &racingDb{Db: newTestDb(t), key: "balance"}
+	h := NewHandler(db, nil)
+	const txn = `{"conditions": [{"key": "balance", "value": "10"}], "operations": [{"op": "put", "key": "balance", "value": "5"}, {"op": "put", "key": "spent", "value": "5"}]}`
+
+	if err := db.Put("balance", "10"); err != nil {
+		t.Fatal(err)
+	}
+	db.races = txRetries + 1
+	if rec := serve(h, http.MethodPost, "/db/_txn", txn); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 once the retries are used up, got %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := db.Get("spent"); err != datastore.ErrNotFound {
+		t.Errorf("Expected a conflicting transaction to write nothing, got %v", err)
+	}
+
+	// A transaction that loses to a concurrent write is retried.
+	db.races = txRetries
+	if rec := serve(h, http.MethodPost, "/db/_txn", txn); rec.Code != http.StatusNoContent {
+		t.Fatalf("Transaction responded with %d: %s", rec.Code, rec.Body)
+	}
+	for key, want := range map[string]string{"balance": "5", "spent": "5"} {
+		if value, err := db.Get(key); err != nil || value != want {
+			t.Errorf("Unexpected value of %s after the transaction: %q, %v", key, value, err)
+		}
+	}
+
+	// Now the condition fails.
+	if rec := serve(h, http.MethodPost, "/db/_txn", txn); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a failed condition, got %d", rec.Code)
+	}
+}
+
+func TestHandler_Admin(t *testing.T) {
+	db := newTestDb(t)
+	h := NewHandler(db, nil)
+	for i := 0; i < 50; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := serve(h, http.MethodPost, "/admin/compact", "")
+	var body struct {
+		Segments []datastore.SegmentInfo `json:"segments"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); rec.Code != http.StatusOK || err != nil || len(body.Segments) != len(db.Segments()) {
+		t.Errorf("Compaction responded with %d and %+v, %v", rec.Code, body, err)
+	}
+
+	rec = serve(h, http.MethodGet, "/admin/backup", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("Backup responded with %d as %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	dir, err := ioutil.TempDir("", "test-dbserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := datastore.Restore(rec.Body, filepath.Join(dir, "restored")); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := datastore.NewDb(filepath.Join(dir, "restored"), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if value, err := restored.Get("key4"); err != nil || value != "value49" {
+		t.Errorf("Unexpected restored value %q, %v", value, err)
+	}
+}
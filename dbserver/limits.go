@@ -0,0 +1,74 @@
+package dbserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+// DefaultMaxBodySize is the limit of request bodies unless WithLimits sets another.
+const DefaultMaxBodySize = 32 << 20
+
+// Limits bound the keys and request bodies of the db API. cmd/dbrouter serves the same
+// API and checks its requests with them too.
+type Limits struct {
+	MaxKeySize  int
+	MaxBodySize int64
+}
+
+// DefaultLimits are the limits of a handler without WithLimits.
+var DefaultLimits = Limits{MaxKeySize: datastore.DefaultMaxKeySize, MaxBodySize: DefaultMaxBodySize}
+
+// CheckKey returns a message for the client if key is invalid.
+func (l Limits) CheckKey(key string) string {
+	switch {
+	case key == "":
+		return "Key required"
+	case len(key) > l.MaxKeySize:
+		return "Key is too long"
+	case !utf8.ValidString(key):
+		return "Key is not valid UTF-8"
+	}
+	return ""
+}
+
+// Key returns the key of a /db/{key} request. A key is a single path segment; slashes
+// in keys are escaped as %2F. It responds with 400 and returns false if the key is
+// invalid.
+func (l Limits) Key(rw http.ResponseWriter, req *http.Request) (string, bool) {
+	segment := strings.TrimPrefix(req.URL.EscapedPath(), "/db/")
+	key, err := url.PathUnescape(segment)
+	if err != nil || strings.Contains(segment, "/") {
+		writeError(rw, http.StatusBadRequest, "Bad key")
+		return "", false
+	}
+	if message := l.CheckKey(key); message != "" {
+		writeError(rw, http.StatusBadRequest, message)
+		return "", false
+	}
+	return key, true
+}
+
+// DecodeBody reads the JSON request body into v. It responds with 413 to a body over the
+// limit and with 400 to a malformed one, and returns false then.
+func (l Limits) DecodeBody(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, l.MaxBodySize)).Decode(v); err != nil {
+		writeBodyError(rw, err)
+		return false
+	}
+	return true
+}
+
+func writeBodyError(rw http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeError(rw, http.StatusRequestEntityTooLarge, "Request body is too large")
+		return
+	}
+	writeError(rw, http.StatusBadRequest, "Bad request")
+}
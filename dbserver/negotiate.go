@@ -0,0 +1,129 @@
+package dbserver
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+const (
+	contentJSON = "application/json"
+	contentText = "text/plain; charset=utf-8"
+)
+
+// negotiate returns the offered media type the Accept header of req prefers, the first
+// offer if it has none, or "" if it accepts none of them. Offers may carry parameters,
+// which are ignored in matching.
+func negotiate(req *http.Request, offers ...string) string {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		// Earlier offers win ties.
+		if q := quality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// quality returns the q-value the Accept header gives to offer: that of its most specific
+// matching media range, as RFC 9110 section 12.5.1 requires, or 0 if none matches.
+func quality(accept, offer string) float64 {
+	offerType, _, _ := mime.ParseMediaType(offer)
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		s := matchMedia(mediaRange, offerType)
+		if s <= specificity {
+			continue
+		}
+		rangeQ := 1.0
+		if v, ok := params["q"]; ok {
+			if rangeQ, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		q, specificity = rangeQ, s
+	}
+	return q
+}
+
+// matchMedia returns how specifically the media range of an Accept header covers
+// mediaType: 2 for the type itself, 1 for type/*, 0 for */* and -1 if it does not.
+func matchMedia(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	}
+	if prefix, ok := strings.CutSuffix(mediaRange, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+		return 1
+	}
+	return -1
+}
+
+// ReadValue reads the value of a key write: the whole body if it is text/plain, or the
+// value field of JSON otherwise, which is what the API took before text was supported.
+// It responds with an error and returns false if it cannot.
+func (l Limits) ReadValue(rw http.ResponseWriter, req *http.Request) (string, bool) {
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "text/plain" {
+		data, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, l.MaxBodySize))
+		if err != nil {
+			writeBodyError(rw, err)
+			return "", false
+		}
+		return string(data), true
+	}
+
+	var body struct {
+		Value string `json:"value"`
+	}
+	if !l.DecodeBody(rw, req, &body) {
+		return "", false
+	}
+	return body.Value, true
+}
+
+// AcceptValue returns the media type a value is sent as in response to req: JSON or, if
+// the Accept header prefers it, text/plain. It responds with 406 Not Acceptable and
+// returns false if the client takes neither.
+func AcceptValue(rw http.ResponseWriter, req *http.Request) (string, bool) {
+	contentType := negotiate(req, contentJSON, contentText)
+	if contentType == "" {
+		writeError(rw, http.StatusNotAcceptable, "Values are available as application/json or text/plain")
+		return "", false
+	}
+	return contentType, true
+}
+
+// WriteValue responds with the value of key as contentType, which AcceptValue returned.
+// The response to HEAD has the headers of the response to GET, but no body.
+func WriteValue(rw http.ResponseWriter, req *http.Request, contentType, key, value string) {
+	var data []byte
+	if contentType == contentText {
+		data = []byte(value)
+	} else {
+		data, _ = json.Marshal(datastore.KeyValue{Key: key, Value: value})
+		data = append(data, '\n')
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	rw.Header().Set("Vary", "Accept")
+	rw.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		rw.Write(data)
+	}
+}
@@ -0,0 +1,245 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+// Follower copies the records of a leader into its own db. Until it is promoted,
+// the db should only be written by the follower.
+type Follower struct {
+	db     *datastore.Db
+	leader string
+	id     string
+	client *http.Client
+
+	promoted atomic.Bool
+
+	mutex sync.Mutex
+	// The position in the leader's log everything before which has been applied.
+	epoch   string
+	segment int
+	offset  int64
+}
+
+type FollowerOption func(*Follower)
+
+func WithHTTPClient(c *http.Client) FollowerOption {
+	return func(f *Follower) { f.client = c }
+}
+
+// NewFollower creates a follower of the leader at leaderURL; id identifies it in the
+// leader's follower list.
+func NewFollower(db *datastore.Db, leaderURL, id string, opts ...FollowerOption) *Follower {
+	f := &Follower{
+		db:     db,
+		leader: strings.TrimSuffix(leaderURL, "/"),
+		id:     id,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Run syncs with the leader every interval until ctx is done or the follower is promoted.
+func (f *Follower) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.SyncOnce(ctx); err != nil {
+			log.Printf("Failed to sync with the leader %s: %s", f.leader, err)
+		}
+		if f.Promoted() {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SyncOnce applies the records the leader has written since the last sync. If the
+// leader restarted or merged the segment the follower was reading, the whole db is
+// copied again.
+func (f *Follower) SyncOnce(ctx context.Context) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.promoted.Load() {
+		return nil
+	}
+
+	var list SegmentList
+	if err := f.get(ctx, "/replication/segments", &list); err != nil {
+		return err
+	}
+
+	start := -1
+	if list.Epoch == f.epoch {
+		for i, s := range list.Segments {
+			if s.ID == f.segment {
+				start = i
+			}
+		}
+	}
+	if start < 0 {
+		return f.resync(ctx, list)
+	}
+
+	for i, s := range list.Segments[start:] {
+		offset := f.offset
+		if i > 0 {
+			offset = s.Start
+		}
+		records, n, err := f.fetch(ctx, s, offset)
+		if err != nil {
+			return err
+		}
+
+		b := new(datastore.WriteBatch)
+		for _, r := range records {
+			if r.Deleted {
+				b.Delete(r.Key)
+			} else {
+				b.Put(r.Key, r.Value)
+			}
+		}
+		if err := f.db.Write(b); err != nil {
+			return err
+		}
+		f.segment, f.offset = s.ID, offset+int64(n)
+	}
+	return nil
+}
+
+// resync reads every segment of the leader and writes the difference with the local
+// db as a single batch. Replaying the segments one by one is not enough: a merged
+// segment has lost the tombstones of deleted keys.
+func (f *Follower) resync(ctx context.Context, list SegmentList) error {
+	log.Printf("Copying all data from the leader %s", f.leader)
+
+	state := make(map[string]datastore.Record)
+	var (
+		segment int
+		offset  int64
+	)
+	for _, s := range list.Segments {
+		records, n, err := f.fetch(ctx, s, s.Start)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			state[r.Key] = r
+		}
+		segment, offset = s.ID, s.Start+int64(n)
+	}
+
+	local, err := f.db.Scan("")
+	if err != nil {
+		return err
+	}
+	b := new(datastore.WriteBatch)
+	for _, kv := range local {
+		if r, ok := state[kv.Key]; !ok || r.Deleted {
+			b.Delete(kv.Key)
+		}
+	}
+	for _, r := range state {
+		if !r.Deleted {
+			b.Put(r.Key, r.Value)
+		}
+	}
+	if err := f.db.Write(b); err != nil {
+		return err
+	}
+
+	f.epoch, f.segment, f.offset = list.Epoch, segment, offset
+	return nil
+}
+
+// fetch reads the records of a leader segment from offset on. Encrypted segments need
+// the same keys on the follower.
+func (f *Follower) fetch(ctx context.Context, segment datastore.SegmentInfo, offset int64) ([]datastore.Record, int, error) {
+	query := url.Values{}
+	query.Set("offset", fmt.Sprint(offset))
+	query.Set("follower", f.id)
+
+	var data []byte
+	err := f.do(ctx, fmt.Sprintf("/replication/segments/%d?%s", segment.ID, query.Encode()), func(body io.Reader) (err error) {
+		data, err = io.ReadAll(body)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return f.db.DecodeSegment(segment, data)
+}
+
+func (f *Follower) get(ctx context.Context, path string, out interface{}) error {
+	return f.do(ctx, path, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(out)
+	})
+}
+
+func (f *Follower) do(ctx context.Context, path string, read func(io.Reader) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded with %s", resp.Status)
+	}
+	return read(resp.Body)
+}
+
+// Promote stops replication, so the follower's db can take writes. A sync in progress
+// completes first.
+func (f *Follower) Promote() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.promoted.Store(true)
+}
+
+func (f *Follower) Promoted() bool { return f.promoted.Load() }
+
+// ReadOnly reports whether the db must reject client writes.
+func (f *Follower) ReadOnly() bool { return !f.Promoted() }
+
+// Handler serves POST /admin/promote.
+func (f *Follower) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/promote", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f.Promote()
+		log.Printf("Promoted to leader, stopped following %s", f.leader)
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
@@ -0,0 +1,172 @@
+package replication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+)
+
+// SegmentList is the response of GET /replication/segments. The epoch changes whenever
+// the leader starts, so followers know that segment ids no longer mean the same data.
+type SegmentList struct {
+	Epoch    string                  `json:"epoch"`
+	Segments []datastore.SegmentInfo `json:"segments"`
+}
+
+// FollowerStatus is the last position a follower read from, as seen by the leader.
+// Lag is the number of bytes the follower has not fetched yet, or -1 if its segment
+// was merged away.
+type FollowerStatus struct {
+	ID       string    `json:"id"`
+	Segment  int       `json:"segment"`
+	Offset   int64     `json:"offset"`
+	Lag      int64     `json:"lag"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// Leader serves the segments of db to followers.
+type Leader struct {
+	db    *datastore.Db
+	epoch string
+	now   func() time.Time
+
+	mutex     sync.Mutex
+	followers map[string]*FollowerStatus
+}
+
+func NewLeader(db *datastore.Db) *Leader {
+	return &Leader{
+		db:        db,
+		epoch:     newEpoch(),
+		now:       time.Now,
+		followers: make(map[string]*FollowerStatus),
+	}
+}
+
+func newEpoch() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Handler serves the replication API under /replication/.
+func (l *Leader) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replication/segments", l.serveSegments)
+	mux.HandleFunc("/replication/segments/", l.serveSegment)
+	mux.HandleFunc("/replication/followers", l.serveFollowers)
+	return mux
+}
+
+// Followers returns the followers that have fetched from this leader, sorted by id.
+func (l *Leader) Followers() []FollowerStatus {
+	segments := l.db.Segments()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	res := make([]FollowerStatus, 0, len(l.followers))
+	for _, f := range l.followers {
+		status := *f
+		status.Lag = lag(segments, status.Segment, status.Offset)
+		res = append(res, status)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+func lag(segments []datastore.SegmentInfo, id int, offset int64) int64 {
+	for i, s := range segments {
+		if s.ID != id {
+			continue
+		}
+		res := s.Size - offset
+		for _, next := range segments[i+1:] {
+			res += next.Size - next.Start
+		}
+		return res
+	}
+	return -1
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func (l *Leader) serveSegments(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, SegmentList{Epoch: l.epoch, Segments: l.db.Segments()})
+}
+
+// serveSegment returns the records of a segment starting at the offset query parameter.
+// A follower passes its id so that its position is tracked.
+func (l *Leader) serveSegment(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/replication/segments/"))
+	if err != nil {
+		http.Error(rw, "Bad segment id", http.StatusBadRequest)
+		return
+	}
+	var offset int64
+	if o := req.URL.Query().Get("offset"); o != "" {
+		if offset, err = strconv.ParseInt(o, 10, 64); err != nil {
+			http.Error(rw, "Bad offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := l.db.ReadSegment(id, offset)
+	if err == datastore.ErrSegmentNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if follower := req.URL.Query().Get("follower"); follower != "" {
+		l.track(follower, id, offset+int64(len(data)))
+	}
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(data)
+}
+
+func (l *Leader) track(follower string, segment int, offset int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.followers[follower] = &FollowerStatus{
+		ID:       follower,
+		Segment:  segment,
+		Offset:   offset,
+		LastSeen: l.now(),
+	}
+}
+
+func (l *Leader) serveFollowers(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, l.Followers())
+}
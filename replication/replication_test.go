@@ -0,0 +1,231 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/KPI-3-Architecture-Labs/lab4/datastore"
+	"github.com/KPI-3-Architecture-Labs/lab4/dbserver"
+)
+
+func newDb(t *testing.T, segmentSize int64, opts ...datastore.Option) *datastore.Db {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "replication-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(dir, segmentSize, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return db
+}
+
+// syncFollower retries SyncOnce, as a leader compaction may remove a segment mid-sync.
+func syncFollower(t *testing.T, f *Follower) {
+	t.Helper()
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = f.SyncOnce(context.Background()); err == nil {
+			return
+		}
+	}
+	t.Fatalf("Failed to sync: %s", err)
+}
+
+func assertSameData(t *testing.T, leader, follower *datastore.Db) {
+	t.Helper()
+	want, err := leader.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := follower.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Follower data %v differs from the leader's %v", got, want)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leaderDb := newDb(t, 1024)
+	leader := NewLeader(leaderDb)
+	server := httptest.NewServer(leader.Handler())
+	defer server.Close()
+
+	followerDbs := []*datastore.Db{newDb(t, 1024), newDb(t, 1024)}
+	followers := []*Follower{
+		NewFollower(followerDbs[0], server.URL, "f1"),
+		NewFollower(followerDbs[1], server.URL, "f2"),
+	}
+	// Stale data a follower had before it joined.
+	followerDbs[1].Put("stale", "value")
+
+	syncAll := func() {
+		for i, f := range followers {
+			syncFollower(t, f)
+			assertSameData(t, leaderDb, followerDbs[i])
+		}
+	}
+
+	t.Run("initial copy", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			leaderDb.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		}
+		syncAll()
+	})
+
+	t.Run("new records", func(t *testing.T) {
+		leaderDb.Put("key1", "updated")
+		leaderDb.Delete("key2")
+		b := new(datastore.WriteBatch)
+		b.Put("key3", "batched")
+		b.Delete("key4")
+		leaderDb.Write(b)
+		syncAll()
+	})
+
+	t.Run("merged segments", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			leaderDb.Put(fmt.Sprintf("key%d", i%20), strings.Repeat("v", i%7+1))
+		}
+		leaderDb.Delete("key5")
+		syncAll()
+
+		for i := 0; i < 50; i++ {
+			leaderDb.Put(fmt.Sprintf("more%d", i), "value")
+		}
+		syncAll()
+	})
+
+	t.Run("follower offsets", func(t *testing.T) {
+		statuses := leader.Followers()
+		if len(statuses) != 2 || statuses[0].ID != "f1" || statuses[1].ID != "f2" {
+			t.Fatalf("Unexpected followers %+v", statuses)
+		}
+		for _, s := range statuses {
+			if s.Lag != 0 {
+				t.Errorf("Follower %s lags by %d bytes after a sync", s.ID, s.Lag)
+			}
+		}
+
+		leaderDb.Put("lagging", "value")
+		for _, s := range leader.Followers() {
+			if s.Lag <= 0 {
+				t.Errorf("Follower %s lag is %d after a write", s.ID, s.Lag)
+			}
+		}
+	})
+}
+
+func TestLeaderRestart(t *testing.T) {
+	first := newDb(t, 1024)
+	first.Put("old", "value")
+	var current atomic.Value
+	current.Store(NewLeader(first).Handler())
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		current.Load().(http.Handler).ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+
+	followerDb := newDb(t, 1024)
+	f := NewFollower(followerDb, server.URL, "f")
+	syncFollower(t, f)
+
+	// A new leader reuses segment ids for other data.
+	second := newDb(t, 1024)
+	second.Put("new", "value")
+	current.Store(NewLeader(second).Handler())
+
+	syncFollower(t, f)
+	assertSameData(t, second, followerDb)
+}
+
+func TestPromote(t *testing.T) {
+	leaderDb := newDb(t, 1024)
+	server := httptest.NewServer(NewLeader(leaderDb).Handler())
+	defer server.Close()
+
+	followerDb := newDb(t, 1024)
+	f := NewFollower(followerDb, server.URL, "f")
+	api := httptest.NewServer(dbserver.NewHandler(followerDb, nil, dbserver.WithReadOnly(f.ReadOnly)))
+	defer api.Close()
+	admin := httptest.NewServer(f.Handler())
+	defer admin.Close()
+
+	leaderDb.Put("key", "value")
+	syncFollower(t, f)
+
+	put := func() int {
+		resp, err := http.Post(api.URL+"/db/key", "application/json", strings.NewReader(`{"value":"local"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := put(); code != http.StatusForbidden {
+		t.Errorf("Write to a follower got %d, want %d", code, http.StatusForbidden)
+	}
+
+	resp, err := http.Post(admin.URL+"/admin/promote", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || !f.Promoted() {
+		t.Fatalf("Promotion failed with %d", resp.StatusCode)
+	}
+
+	if code := put(); code != http.StatusCreated {
+		t.Errorf("Write to a promoted follower got %d, want %d", code, http.StatusCreated)
+	}
+
+	leaderDb.Put("key", "from old leader")
+	syncFollower(t, f)
+	if value, _ := followerDb.Get("key"); value != "local" {
+		t.Errorf("Promoted follower has %q, want %q", value, "local")
+	}
+}
+
+func TestEncryptedReplication(t *testing.T) {
+	keys, err := datastore.ParseKeyring("k1:" + strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaderDb := newDb(t, 300, datastore.WithEncryption(keys))
+	server := httptest.NewServer(NewLeader(leaderDb).Handler())
+	defer server.Close()
+
+	followerDb := newDb(t, 300, datastore.WithEncryption(keys))
+	follower := NewFollower(followerDb, server.URL, "follower")
+	for i := 0; i < 20; i++ {
+		if err := leaderDb.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%7 == 0 {
+			syncFollower(t, follower)
+		}
+	}
+	syncFollower(t, follower)
+	assertSameData(t, leaderDb, followerDb)
+
+	plain := NewFollower(newDb(t, 300), server.URL, "no-keys")
+	if err := plain.SyncOnce(context.Background()); err == nil {
+		t.Error("Expected a follower without the key to fail")
+	}
+}
@@ -0,0 +1,179 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+type Exporter interface {
+	Export(service string, s *Span) error
+	Close() error
+}
+
+// JSONExporter writes every finished span as one line of OTLP/JSON
+// (an ExportTraceServiceRequest), the same layout the OpenTelemetry file exporter uses.
+type JSONExporter struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	closer io.Closer
+}
+
+func NewJSONExporter(out io.Writer) *JSONExporter {
+	return &JSONExporter{out: out}
+}
+
+// NewExporter returns an exporter for the -trace-export flag value: "" disables export,
+// "stdout" writes to the standard output and anything else is a file path to append to.
+func NewExporter(target string) (Exporter, error) {
+	switch target {
+	case "":
+		return nil, nil
+	case "stdout":
+		return NewJSONExporter(os.Stdout), nil
+	}
+	f, err := os.OpenFile(target, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONExporter{out: f, closer: f}, nil
+}
+
+func (e *JSONExporter) Export(service string, s *Span) error {
+	data, err := json.Marshal(toOTLP(service, s))
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err = e.out.Write(data)
+	return err
+}
+
+func (e *JSONExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+func logExportError(err error) {
+	log.Printf("Failed to export span: %s", err)
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+const (
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+func toOTLP(service string, s *Span) otlpRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	span := otlpSpan{
+		TraceID:           s.ctx.TraceID.String(),
+		SpanID:            s.ctx.SpanID.String(),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusOk},
+	}
+	if s.parent.IsValid() {
+		span.ParentSpanID = s.parent.String()
+	}
+	for _, attr := range s.attrs {
+		span.Attributes = append(span.Attributes, toOTLPAttribute(attr.Key, attr.Value))
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{toOTLPAttribute("service.name", service)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/KPI-3-Architecture-Labs/lab4/tracing"},
+				Spans: []otlpSpan{span},
+			}},
+		}},
+	}
+}
+
+func toOTLPAttribute(key string, value interface{}) otlpAttribute {
+	var v otlpValue
+	switch val := value.(type) {
+	case string:
+		v.StringValue = &val
+	case int:
+		s := strconv.Itoa(val)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(val, 10)
+		v.IntValue = &s
+	case bool:
+		v.BoolValue = &val
+	default:
+		s := fmt.Sprint(val)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
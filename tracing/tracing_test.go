@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const value = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, err := ParseTraceparent(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Unexpected trace id %s", sc.TraceID)
+	}
+	if sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected span id %s", sc.SpanID)
+	}
+	if sc.Traceparent() != value {
+		t.Errorf("Round trip mismatch: %s", sc.Traceparent())
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, v := range invalid {
+		if _, err := ParseTraceparent(v); err == nil {
+			t.Errorf("Expected an error for %q", v)
+		}
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	var out bytes.Buffer
+	exporter := NewJSONExporter(&out)
+
+	backendTracer := NewTracer("backend", exporter)
+	backend := httptest.NewServer(backendTracer.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, span := backendTracer.Start(r.Context(), "work", SpanKindInternal)
+		span.End()
+	})))
+
+	frontendTracer := NewTracer("frontend", exporter)
+	client := &http.Client{Transport: frontendTracer.Transport(nil)}
+	frontend := httptest.NewServer(frontendTracer.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, backend.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	})))
+
+	root := SpanContext{Flags: flagSampled}
+	root.TraceID[0], root.SpanID[0] = 1, 1
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, frontend.URL, nil)
+	req.Header.Set(TraceparentHeader, root.Traceparent())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Close waits for in-flight handlers, so every span has been exported after it.
+	frontend.Close()
+	backend.Close()
+
+	spans := make(map[string]otlpSpan)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var r otlpRequest
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		service := *r.ResourceSpans[0].Resource.Attributes[0].Value.StringValue
+		span := r.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		if span.TraceID != root.TraceID.String() {
+			t.Errorf("Span %s has trace id %s", span.Name, span.TraceID)
+		}
+		spans[fmt.Sprintf("%s/%d", service, span.Kind)] = span
+	}
+
+	parents := map[string]string{
+		"frontend/2": "",
+		"frontend/3": "frontend/2",
+		"backend/2":  "frontend/3",
+		"backend/1":  "backend/2",
+	}
+	if len(spans) != len(parents) {
+		t.Fatalf("Expected %d spans, got %d", len(parents), len(spans))
+	}
+	for name, parent := range parents {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Span %s was not exported", name)
+			continue
+		}
+		expected := root.SpanID.String()
+		if parent != "" {
+			expected = spans[parent].SpanID
+		}
+		if span.ParentSpanID != expected {
+			t.Errorf("Span %s has parent %s, expected %s", name, span.ParentSpanID, expected)
+		}
+	}
+}